@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/backups"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/sirupsen/logrus"
+)
+
+// backupMetadataMicroversion is the first Block Storage API microversion
+// supporting metadata on backups.
+const backupMetadataMicroversion = "3.43"
+
+// createFromBackupMicroversion is the first Block Storage API microversion
+// allowing to create volumes from backups. Older ones ignore backup_id.
+const createFromBackupMicroversion = "3.47"
+
+// restoreTimeout bounds how long restores are watched for, to fix up the volume
+// once they're done.
+const restoreTimeout = 24 * time.Hour
+
+// restoreWatchInterval is how often the status of volumes being restored is
+// checked.
+const restoreWatchInterval = 5 * time.Second
+
+func (d *CinderDriver) backupClient() *gophercloud.ServiceClient {
+	client := *d.storageClient
+	client.Microversion = backupMetadataMicroversion
+
+	return &client
+}
+
+func (d *CinderDriver) BackupCreate(ctx context.Context, logger *logrus.Entry, req BackupCreateReq) BackupCreateResp {
+	resp := BackupCreateResp{}
+
+	vol, sub, err := d.lookupVolume(req.Volume)
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	} else if sub != nil {
+		resp.Err = fmt.Sprintf("volume %s is a sub-volume of %s, back up its parent instead", req.Volume, vol.Name)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	logger = logger.WithField("VolID", vol.ID)
+
+	opts := backups.CreateOpts{
+		VolumeID:    vol.ID,
+		Name:        req.Name,
+		Description: req.Description,
+		Incremental: req.Incremental,
+		Metadata: map[string]string{
+			metadataFieldVolume: vol.Name,
+		},
+	}
+	if opts.Name == "" {
+		opts.Name = fmt.Sprintf("%s-%s", vol.Name, time.Now().UTC().Format("20060102-150405"))
+	}
+	for _, field := range contentMetadataFields {
+		if v := vol.Metadata[field]; v != "" {
+			opts.Metadata[field] = v
+		}
+	}
+
+	// Cinder refuses to do an incremental backup without a full one.
+	if req.Incremental {
+		list, err := d.listBackups(vol.Name)
+		if err != nil {
+			resp.Err = err.Error()
+			logger.Error(resp.Err)
+
+			return resp
+		}
+
+		opts.Incremental = false
+		for _, b := range list {
+			if b.VolumeID == vol.ID && b.Status == "available" {
+				opts.Incremental = true
+			}
+		}
+		if !opts.Incremental {
+			logger.Infof("Volume %s has no backup yet, doing a full backup.", vol.Name)
+		}
+	}
+
+	// Cinder refuses to back up attached volumes unless forced.
+	if len(vol.Attachments) > 0 {
+		opts.Force = true
+
+		if err := d.flushFilesystem(logger, vol); err != nil {
+			resp.Err = err.Error()
+			logger.Error(resp.Err)
+
+			return resp
+		}
+	}
+
+	backup, err := backups.Create(d.backupClient(), opts).Extract()
+	if err != nil {
+		resp.Err = fmt.Sprintf("could not back up volume %s: %v", req.Volume, err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	// Backups might take hours, their progress is followed through BackupGet.
+	logger.Infof("Backup %s (%s) of volume %s has been started.", opts.Name, backup.ID, vol.Name)
+
+	backup.Metadata = &opts.Metadata
+	resp.Backup = toBackup(*backup)
+
+	return resp
+}
+
+func (d *CinderDriver) BackupList(ctx context.Context, logger *logrus.Entry, req BackupListReq) BackupListResp {
+	resp := BackupListResp{
+		Backups: make([]Backup, 0),
+	}
+
+	list, err := d.listBackups(req.Volume)
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	for _, b := range list {
+		resp.Backups = append(resp.Backups, toBackup(b))
+	}
+
+	return resp
+}
+
+func (d *CinderDriver) BackupGet(ctx context.Context, logger *logrus.Entry, req BackupGetReq) BackupGetResp {
+	resp := BackupGetResp{}
+
+	backup, err := d.findBackup(req.Name)
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	resp.Backup = toBackup(backup)
+	return resp
+}
+
+func (d *CinderDriver) BackupRemove(ctx context.Context, logger *logrus.Entry, req BackupRemoveReq) BackupRemoveResp {
+	resp := BackupRemoveResp{}
+
+	backup, err := d.findBackup(req.Name)
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	if err := backups.Delete(d.storageClient, backup.ID).ExtractErr(); err != nil {
+		resp.Err = fmt.Sprintf("failed to delete backup %s: %v", req.Name, err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	logger.Infof("Deletion of backup %s (%s) has been started.", backup.Name, backup.ID)
+
+	return resp
+}
+
+// BackupRestore restores a backup into an existing volume, which must not be
+// mounted. The restore goes on in the background.
+func (d *CinderDriver) BackupRestore(ctx context.Context, logger *logrus.Entry, req BackupRestoreReq) BackupRestoreResp {
+	resp := BackupRestoreResp{}
+
+	backup, err := d.findBackup(req.Name)
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	vol, sub, err := d.lookupVolume(req.Volume)
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	} else if sub != nil {
+		resp.Err = fmt.Sprintf("volume %s is a sub-volume of %s, backups can only be restored into its parent", req.Volume, vol.Name)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	logger = logger.WithField("VolID", vol.ID)
+
+	unlock := d.locks.lock(vol.ID)
+	defer unlock()
+
+	// The volume might have been mounted or attached while waiting for the
+	// lock.
+	fresh, err := volumes.Get(d.storageClient, vol.ID).Extract()
+	if err != nil {
+		resp.Err = fmt.Sprintf("could not get volume %s: %v", req.Volume, err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+	vol = *fresh
+
+	if backup.Size > vol.Size {
+		resp.Err = fmt.Sprintf("backup %s (%d GB) is bigger than volume %s (%d GB)", req.Name, backup.Size, req.Volume, vol.Size)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	if mountpoint, err := d.userMountpoint(vol); err != nil {
+		resp.Err = fmt.Sprintf("checking if volume is still mounted: %v", err)
+		logger.Error(resp.Err)
+
+		return resp
+	} else if mountpoint != "" {
+		resp.Err = fmt.Sprintf("volume %s is still mounted", req.Volume)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+	if count, err := mountedSubVolumes(vol); err != nil {
+		resp.Err = fmt.Sprintf("checking if sub-volumes are still mounted: %v", err)
+		logger.Error(resp.Err)
+
+		return resp
+	} else if count > 0 {
+		resp.Err = fmt.Sprintf("%d sub-volumes of volume %s are still mounted", count, req.Volume)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	// Unmount() leaves volumes attached, but Cinder only restores backups into
+	// available volumes.
+	if err := closeEncrypted(vol); err != nil {
+		resp.Err = fmt.Sprintf("closing encrypted volume: %v", err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+	if len(vol.Attachments) > 0 {
+		if err := d.detachVolume(ctx, logger, vol, false, true); err != nil {
+			resp.Err = fmt.Sprintf("detaching volume from current server: %v", err)
+			logger.Error(resp.Err)
+
+			return resp
+		}
+	}
+
+	// Cinder overwrites the name and the metadata of the volume with those of
+	// the backed up volume. They're recorded beforehand, so they can be put
+	// back even if the plugin restarts during the restore.
+	restore := pendingRestore{
+		Backup:   backup.Name,
+		Name:     vol.Name,
+		Metadata: map[string]string{},
+		Content:  map[string]string{},
+	}
+	for k, v := range vol.Metadata {
+		if strings.HasPrefix(k, "docker-volume-driver:") {
+			restore.Metadata[k] = v
+		}
+	}
+	if backup.Metadata != nil {
+		for _, field := range contentMetadataFields {
+			restore.Content[field] = (*backup.Metadata)[field]
+		}
+	}
+	if err := d.state.update(vol.ID, func(st *volumeState) { st.Restore = &restore }); err != nil {
+		resp.Err = fmt.Sprintf("could not record the restore of volume %s: %v", req.Volume, err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	opts := backups.RestoreOpts{VolumeID: vol.ID}
+	if _, err := backups.RestoreFromBackup(d.storageClient, backup.ID, opts).Extract(); err != nil {
+		resp.Err = fmt.Sprintf("could not restore backup %s into volume %s: %v", req.Name, req.Volume, err)
+		logger.Error(resp.Err)
+
+		if err := d.state.update(vol.ID, func(st *volumeState) { st.Restore = nil }); err != nil {
+			logger.Warnf("Could not clear the restore of volume %s: %v", req.Volume, err)
+		}
+
+		return resp
+	}
+
+	logger.Infof("Restore of backup %s (%s) into volume %s has been started.", backup.Name, backup.ID, vol.Name)
+
+	go d.watchRestore(logger, vol.ID, restore)
+
+	return resp
+}
+
+// pendingRestore is a backup being restored into a volume, along with what has
+// to be put back once it's done.
+type pendingRestore struct {
+	Backup string
+	// Name and Metadata are the name and the plugin metadata of the volume
+	// before the restore.
+	Name     string
+	Metadata map[string]string
+	// Content is the metadata describing the content of the backup.
+	Content map[string]string
+}
+
+// resumeRestores watches again the restores which were still going on when
+// the plugin stopped.
+func (d *CinderDriver) resumeRestores() {
+	for volID, st := range d.state.all() {
+		if st.Restore == nil {
+			continue
+		}
+
+		logger := logrus.WithField("VolID", volID)
+		logger.Infof("Resuming the watch of the restore of backup %s into volume %s.", st.Restore.Backup, st.Restore.Name)
+
+		go d.watchRestore(logger, volID, *st.Restore)
+	}
+}
+
+// watchRestore waits for restore into volID to be done, and puts back the name
+// and the metadata of the volume. When the restore fails, the metadata
+// describing the content of the volume is left as it was before the restore.
+func (d *CinderDriver) watchRestore(logger *logrus.Entry, volID string, restore pendingRestore) {
+	// Restores aren't tied to the request starting them. Errors getting the
+	// volume are retried, as it has to be renamed back in any case.
+	err := waitForEvery(context.Background(), restoreWatchInterval, restoreTimeout, func() (bool, error) {
+		v, err := volumes.Get(d.storageClient, volID).Extract()
+		if err != nil {
+			logger.Warnf("Could not get volume %s while it's being restored: %v", restore.Name, err)
+			return false, nil
+		}
+
+		switch v.Status {
+		case "restoring-backup":
+			return false, nil
+		case "available":
+			return true, nil
+		}
+
+		return false, fmt.Errorf("volume is in %s status", v.Status)
+	})
+
+	metadata := maps.Clone(restore.Metadata)
+	if err != nil {
+		logger.Errorf("Restore of backup %s into volume %s failed: %v", restore.Backup, restore.Name, err)
+	} else {
+		// The content of the volume is now the one of the backup.
+		maps.Copy(metadata, restore.Content)
+	}
+
+	name := restore.Name
+	if _, err := volumes.Update(d.storageClient, volID, volumes.UpdateOpts{Name: &name}).Extract(); err != nil {
+		logger.Errorf("Could not rename volume %s after the restore: %v", restore.Name, err)
+		return
+	}
+	if err := d.updateMetadata(volID, metadata); err != nil {
+		logger.Errorf("Could not restore the metadata of volume %s: %v", restore.Name, err)
+		return
+	}
+
+	if err := d.state.update(volID, func(st *volumeState) { st.Restore = nil }); err != nil {
+		logger.Warnf("Could not clear the restore of volume %s: %v", restore.Name, err)
+	}
+
+	if err == nil {
+		logger.Infof("Backup %s has been restored into volume %s.", restore.Backup, restore.Name)
+	}
+}
+
+// listBackups returns the backups made through the plugin, optionally only
+// those of the given volume.
+func (d *CinderDriver) listBackups(volume string) ([]backups.Backup, error) {
+	list := make([]backups.Backup, 0)
+
+	allPages, err := backups.ListDetail(d.backupClient(), nil).AllPages()
+	if err != nil {
+		return list, fmt.Errorf("listing openstack backups: %v", err)
+	}
+
+	all, err := backups.ExtractBackups(allPages)
+	if err != nil {
+		return list, fmt.Errorf("extracting openstack backups from api response: %v", err)
+	}
+
+	for _, b := range all {
+		if b.Metadata == nil {
+			continue
+		}
+
+		v, ok := (*b.Metadata)[metadataFieldVolume]
+		if !ok || (volume != "" && v != volume) {
+			continue
+		}
+
+		list = append(list, b)
+	}
+
+	return list, nil
+}
+
+// findBackup finds a backup by name among the backups made through the plugin,
+// or by ID.
+func (d *CinderDriver) findBackup(ref string) (backups.Backup, error) {
+	list, err := d.listBackups("")
+	if err != nil {
+		return backups.Backup{}, err
+	}
+
+	matching := make([]backups.Backup, 0, 1)
+	for _, b := range list {
+		if b.ID == ref {
+			return b, nil
+		}
+		if b.Name == ref {
+			matching = append(matching, b)
+		}
+	}
+
+	switch len(matching) {
+	case 1:
+		return matching[0], nil
+	case 0:
+		b, err := backups.Get(d.backupClient(), ref).Extract()
+		if _, ok := err.(gophercloud.ErrDefault404); ok {
+			return backups.Backup{}, fmt.Errorf("backup %s not found", ref)
+		} else if err != nil {
+			return backups.Backup{}, fmt.Errorf("could not get backup %s: %v", ref, err)
+		}
+
+		return *b, nil
+	}
+
+	return backups.Backup{}, fmt.Errorf("%d backups are named %s, use the backup ID instead", len(matching), ref)
+}
+
+func toBackup(b backups.Backup) Backup {
+	backup := Backup{
+		ID:          b.ID,
+		Name:        b.Name,
+		VolumeID:    b.VolumeID,
+		Status:      b.Status,
+		Size:        b.Size,
+		Incremental: b.IsIncremental,
+		FailReason:  b.FailReason,
+		Description: b.Description,
+		CreatedAt:   b.CreatedAt.String(),
+	}
+	if b.Metadata != nil {
+		backup.Volume = (*b.Metadata)[metadataFieldVolume]
+		backup.Metadata = *b.Metadata
+	}
+
+	return backup
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+)
+
+// modeBlock is the value of the mode option making the plugin hand the block
+// device itself to Podman, instead of a filesystem.
+const modeBlock = "block"
+
+// blockDeviceLink is the name of the symlink pointing to the block device of a
+// volume in block mode, under its mountpoint.
+const blockDeviceLink = "device"
+
+func isBlockMode(vol volumes.Volume) bool {
+	return vol.Metadata[metadataFieldMode] == modeBlock
+}
+
+// exposeBlockDevice creates a symlink to dev under the propagated mount, to
+// provide a stable path to the block device of vol.
+func exposeBlockDevice(vol volumes.Volume, dev string) (string, error) {
+	mountpoint := path.Join(propagatedMount, vol.ID)
+	if err := os.MkdirAll(mountpoint, 0750); err != nil {
+		return "", fmt.Errorf("failed to create mountpoint directory %s: %v", mountpoint, err)
+	}
+
+	link := path.Join(mountpoint, blockDeviceLink)
+	if target, err := os.Readlink(link); err == nil && target == dev {
+		return link, nil
+	} else if err == nil {
+		// The device name might change between two attachments.
+		if err := os.Remove(link); err != nil {
+			return "", fmt.Errorf("removing stale device link %s: %v", link, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("reading device link %s: %v", link, err)
+	}
+
+	if err := os.Symlink(dev, link); err != nil {
+		return "", fmt.Errorf("creating device link %s: %v", link, err)
+	}
+
+	return link, nil
+}
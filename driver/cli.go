@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// defaultPluginSocket is where sdk.Handler.ServeUnix("cinder", ...) listens.
+const defaultPluginSocket = "/run/docker/plugins/cinder.sock"
+
+// maxRestoreWaitFailures is how many times in a row getting the volume being
+// restored may fail before giving up waiting for it.
+const maxRestoreWaitFailures = 12
+
+// pluginClient talks to a running plugin through its UNIX socket. It's used by
+// the admin subcommands.
+type pluginClient struct {
+	httpClient *http.Client
+}
+
+func newPluginClient(socket string) *pluginClient {
+	return &pluginClient{
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// call sends req to the given route and decodes the response into resp. The
+// Err field returned by the plugin, if any, is turned into an error.
+func (c *pluginClient) call(route string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("encoding request: %v", err)
+	}
+
+	httpResp, err := c.httpClient.Post("http://plugin"+route, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("calling the plugin: %v", err)
+	}
+	defer httpResp.Body.Close()
+
+	content, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return fmt.Errorf("reading the plugin response: %v", err)
+	}
+
+	var errResp struct {
+		Err string
+	}
+	if err := json.Unmarshal(content, &errResp); err != nil {
+		return fmt.Errorf("unexpected plugin response (%s): %s", httpResp.Status, strings.TrimSpace(string(content)))
+	}
+	if errResp.Err != "" {
+		return errors.New(errResp.Err)
+	}
+
+	if resp == nil {
+		return nil
+	}
+
+	return json.Unmarshal(content, resp)
+}
+
+type command struct {
+	usage       string
+	description string
+	run         func(c *pluginClient, args []string) error
+}
+
+func commands() map[string]command {
+	return map[string]command{
+		"resize": {
+			usage:       "resize <volume> <size>",
+			description: "Extend a volume to the given size (in GB) and grow its filesystem.",
+			run:         resizeCommand,
+		},
+		"snapshot create": {
+			usage:       "snapshot create <volume> [name]",
+			description: "Snapshot a volume. The name defaults to the volume name followed by the date.",
+			run:         snapshotCreateCommand,
+		},
+		"snapshot ls": {
+			usage:       "snapshot ls [volume]",
+			description: "List the snapshots taken through the plugin, optionally only those of a volume.",
+			run:         snapshotListCommand,
+		},
+		"snapshot inspect": {
+			usage:       "snapshot inspect <snapshot>",
+			description: "Show the details of a snapshot, given its name or ID.",
+			run:         snapshotInspectCommand,
+		},
+		"snapshot rm": {
+			usage:       "snapshot rm <snapshot>",
+			description: "Delete a snapshot, given its name or ID.",
+			run:         snapshotRemoveCommand,
+		},
+		"backup create": {
+			usage:       "backup create [--incremental] [--wait] <volume> [name]",
+			description: "Back up a volume. The name defaults to the volume name followed by the date.",
+			run:         backupCreateCommand,
+		},
+		"backup ls": {
+			usage:       "backup ls [volume]",
+			description: "List the backups made through the plugin, optionally only those of a volume.",
+			run:         backupListCommand,
+		},
+		"backup inspect": {
+			usage:       "backup inspect <backup>",
+			description: "Show the details of a backup, given its name or ID.",
+			run:         backupInspectCommand,
+		},
+		"backup rm": {
+			usage:       "backup rm <backup>",
+			description: "Delete a backup, given its name or ID.",
+			run:         backupRemoveCommand,
+		},
+		"backup restore": {
+			usage:       "backup restore [--wait] <backup> <volume>",
+			description: "Restore a backup into an existing volume, which must not be mounted.",
+			run:         backupRestoreCommand,
+		},
+		"retained ls": {
+			usage:       "retained ls",
+			description: "List the volumes retained on removal because of their remove policy.",
+			run:         retainedListCommand,
+		},
+		"retained restore": {
+			usage:       "retained restore <volume> [new name]",
+			description: "Make a retained volume, given its name or ID, available to Podman again.",
+			run:         retainedRestoreCommand,
+		},
+		"transfer create": {
+			usage:       "transfer create <volume>",
+			description: "Offer a volume to another project. Prints the transfer ID and its auth key.",
+			run:         transferCreateCommand,
+		},
+		"transfer ls": {
+			usage:       "transfer ls",
+			description: "List the pending transfers of volumes.",
+			run:         transferListCommand,
+		},
+		"transfer accept": {
+			usage:       "transfer accept <id> <auth key> [name]",
+			description: "Accept a volume transferred from another project.",
+			run:         transferAcceptCommand,
+		},
+		"transfer rm": {
+			usage:       "transfer rm <id>",
+			description: "Cancel a pending transfer.",
+			run:         transferRemoveCommand,
+		},
+	}
+}
+
+// runCommand runs the admin subcommand named by args[0], or by args[0] and
+// args[1] for commands made of two words, against the plugin running on this
+// host.
+func runCommand(args []string) error {
+	cmds := commands()
+
+	if len(args) > 1 {
+		if _, ok := cmds[args[0]+" "+args[1]]; ok {
+			args = append([]string{args[0] + " " + args[1]}, args[2:]...)
+		}
+	}
+
+	cmd, ok := cmds[args[0]]
+	if !ok {
+		printUsage(cmds)
+		if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			return nil
+		}
+		return fmt.Errorf("unknown command %s", args[0])
+	}
+
+	socket := defaultPluginSocket
+	if s, ok := os.LookupEnv("PLUGIN_SOCKET"); ok {
+		socket = s
+	}
+
+	if err := cmd.run(newPluginClient(socket), args[1:]); err != nil {
+		if errors.Is(err, errUsage) {
+			return fmt.Errorf("usage: %s %s", os.Args[0], cmd.usage)
+		}
+		return err
+	}
+
+	return nil
+}
+
+var errUsage = errors.New("invalid usage")
+
+func printUsage(cmds map[string]command) {
+	names := make([]string, 0, len(cmds))
+	width := 0
+	for name, cmd := range cmds {
+		names = append(names, name)
+		width = max(width, len(cmd.usage))
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: %s [command]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Without command, the plugin starts serving on its UNIX socket.\n\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-*s   %s\n", width, cmds[name].usage, cmds[name].description)
+	}
+}
+
+func resizeCommand(c *pluginClient, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+
+	size, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid size %s: %v", args[1], err)
+	}
+
+	return c.call("/Cinder.Resize", VolumeResizeReq{Name: args[0], Size: size}, nil)
+}
+
+func snapshotCreateCommand(c *pluginClient, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+
+	req := SnapshotCreateReq{Volume: args[0]}
+	if len(args) > 1 {
+		req.Name = args[1]
+	}
+
+	var resp SnapshotCreateResp
+	if err := c.call("/Cinder.SnapshotCreate", req, &resp); err != nil {
+		return err
+	}
+
+	fmt.Println(resp.Snapshot.Name)
+	return nil
+}
+
+func snapshotListCommand(c *pluginClient, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+
+	var req SnapshotListReq
+	if len(args) == 1 {
+		req.Volume = args[0]
+	}
+
+	var resp SnapshotListResp
+	if err := c.call("/Cinder.SnapshotList", req, &resp); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVOLUME\tSTATUS\tSIZE\tCREATED\tID")
+	for _, snap := range resp.Snapshots {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d GB\t%s\t%s\n", snap.Name, snap.Volume, snap.Status, snap.Size, snap.CreatedAt, snap.ID)
+	}
+
+	return w.Flush()
+}
+
+func snapshotInspectCommand(c *pluginClient, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	var resp SnapshotGetResp
+	if err := c.call("/Cinder.SnapshotGet", SnapshotGetReq{Name: args[0]}, &resp); err != nil {
+		return err
+	}
+
+	return printJSON(resp.Snapshot)
+}
+
+func snapshotRemoveCommand(c *pluginClient, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	return c.call("/Cinder.SnapshotRemove", SnapshotRemoveReq{Name: args[0]}, nil)
+}
+
+func printJSON(v interface{}) error {
+	content, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(content))
+	return nil
+}
+
+// parseFlags parses the flags of a subcommand, which come before its
+// positional arguments.
+func parseFlags(name string, args []string, define func(fs *flag.FlagSet)) ([]string, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	define(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("%v: %w", err, errUsage)
+	}
+
+	return fs.Args(), nil
+}
+
+func backupCreateCommand(c *pluginClient, args []string) error {
+	var req BackupCreateReq
+	var wait bool
+
+	args, err := parseFlags("backup create", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&req.Incremental, "incremental", false, "")
+		fs.BoolVar(&wait, "wait", false, "")
+	})
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+
+	req.Volume = args[0]
+	if len(args) > 1 {
+		req.Name = args[1]
+	}
+
+	var resp BackupCreateResp
+	if err := c.call("/Cinder.BackupCreate", req, &resp); err != nil {
+		return err
+	}
+
+	fmt.Println(resp.Backup.Name)
+	if !wait {
+		return nil
+	}
+
+	return c.waitForBackup(resp.Backup.ID)
+}
+
+// waitForBackup polls the status of a backup until it's either available or
+// in error.
+func (c *pluginClient) waitForBackup(id string) error {
+	status := ""
+	for {
+		var resp BackupGetResp
+		if err := c.call("/Cinder.BackupGet", BackupGetReq{Name: id}, &resp); err != nil {
+			return err
+		}
+
+		if resp.Backup.Status != status {
+			status = resp.Backup.Status
+			fmt.Fprintf(os.Stderr, "Status: %s\n", status)
+		}
+
+		switch status {
+		case "available":
+			return nil
+		case "error":
+			return fmt.Errorf("backup failed: %s", resp.Backup.FailReason)
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func backupListCommand(c *pluginClient, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+
+	var req BackupListReq
+	if len(args) == 1 {
+		req.Volume = args[0]
+	}
+
+	var resp BackupListResp
+	if err := c.call("/Cinder.BackupList", req, &resp); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVOLUME\tSTATUS\tSIZE\tINCREMENTAL\tCREATED\tID")
+	for _, b := range resp.Backups {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d GB\t%t\t%s\t%s\n", b.Name, b.Volume, b.Status, b.Size, b.Incremental, b.CreatedAt, b.ID)
+	}
+
+	return w.Flush()
+}
+
+func backupInspectCommand(c *pluginClient, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	var resp BackupGetResp
+	if err := c.call("/Cinder.BackupGet", BackupGetReq{Name: args[0]}, &resp); err != nil {
+		return err
+	}
+
+	return printJSON(resp.Backup)
+}
+
+func backupRemoveCommand(c *pluginClient, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	return c.call("/Cinder.BackupRemove", BackupRemoveReq{Name: args[0]}, nil)
+}
+
+func backupRestoreCommand(c *pluginClient, args []string) error {
+	var wait bool
+
+	args, err := parseFlags("backup restore", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&wait, "wait", false, "")
+	})
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return errUsage
+	}
+
+	if err := c.call("/Cinder.BackupRestore", BackupRestoreReq{Name: args[0], Volume: args[1]}, nil); err != nil {
+		return err
+	}
+	if !wait {
+		return nil
+	}
+
+	// Cinder renames the volume at the end of the restore, and the plugin
+	// renames it back right after, so it might not be found for a bit.
+	failures := 0
+	for {
+		time.Sleep(5 * time.Second)
+
+		var resp VolumeGetResp
+		if err := c.call("/VolumeDriver.Get", VolumeGetReq{Name: args[1]}, &resp); err != nil {
+			if failures++; failures >= maxRestoreWaitFailures {
+				return fmt.Errorf("waiting for the restore of backup %s into volume %s: %v", args[0], args[1], err)
+			}
+			continue
+		}
+		failures = 0
+
+		switch resp.Volume.Status["Status"] {
+		case "available":
+			return nil
+		case "error", "error_restoring":
+			return fmt.Errorf("restoring backup %s into volume %s failed", args[0], args[1])
+		}
+	}
+}
+
+func retainedListCommand(c *pluginClient, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	var resp RetainedListResp
+	if err := c.call("/Cinder.RetainedList", RetainedListReq{}, &resp); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tREMOVED\tID")
+	for _, vol := range resp.Volumes {
+		fmt.Fprintf(w, "%s\t%d GB\t%s\t%s\n", vol.Name, vol.Size, vol.RemovedAt, vol.ID)
+	}
+
+	return w.Flush()
+}
+
+func retainedRestoreCommand(c *pluginClient, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+
+	req := RetainedRestoreReq{Name: args[0]}
+	if len(args) > 1 {
+		req.NewName = args[1]
+	}
+
+	return c.call("/Cinder.RetainedRestore", req, nil)
+}
+
+func transferCreateCommand(c *pluginClient, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	var resp TransferCreateResp
+	if err := c.call("/Cinder.TransferCreate", TransferCreateReq{Volume: args[0]}, &resp); err != nil {
+		return err
+	}
+
+	fmt.Printf("ID:       %s\nAuth key: %s\n", resp.Transfer.ID, resp.Transfer.AuthKey)
+	return nil
+}
+
+func transferListCommand(c *pluginClient, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	var resp TransferListResp
+	if err := c.call("/Cinder.TransferList", TransferListReq{}, &resp); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "ID\tVOLUME\tCREATED")
+	for _, t := range resp.Transfers {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", t.ID, t.Volume, t.CreatedAt)
+	}
+
+	return w.Flush()
+}
+
+func transferAcceptCommand(c *pluginClient, args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return errUsage
+	}
+
+	req := TransferAcceptReq{ID: args[0], AuthKey: args[1]}
+	if len(args) > 2 {
+		req.Name = args[2]
+	}
+
+	var resp TransferAcceptResp
+	if err := c.call("/Cinder.TransferAccept", req, &resp); err != nil {
+		return err
+	}
+
+	if resp.Warning != "" {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", resp.Warning)
+	}
+
+	fmt.Println(resp.Name)
+	return nil
+}
+
+func transferRemoveCommand(c *pluginClient, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	return c.call("/Cinder.TransferRemove", TransferRemoveReq{ID: args[0]}, nil)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// findSourceVolume resolves the source_volume option, either the name of a
+// volume managed by this plugin or the ID of any Cinder volume.
+func (d *CinderDriver) findSourceVolume(source string) (volumes.Volume, error) {
+	vol, sub, err := d.lookupVolume(source)
+	if err == nil && sub != nil {
+		return volumes.Volume{}, fmt.Errorf("source volume %s is a sub-volume of %s, which can't be cloned separately", source, vol.Name)
+	} else if err == nil {
+		return vol, nil
+	} else if err != errVolumeNotFound {
+		return volumes.Volume{}, err
+	}
+
+	v, err := volumes.Get(d.storageClient, source).Extract()
+	if _, ok := err.(gophercloud.ErrDefault404); ok {
+		return volumes.Volume{}, fmt.Errorf("source volume %s: %v", source, errVolumeNotFound)
+	} else if err != nil {
+		return volumes.Volume{}, fmt.Errorf("could not get source volume %s: %v", source, err)
+	}
+
+	return *v, nil
+}
+
+// inheritSourceOpts fills the options describing the content of the volume
+// from the metadata of its source, i.e. a volume or a snapshot, as the new
+// volume holds the same data.
+func inheritSourceOpts(opts *VolumeCreateOpts, metadata map[string]string) {
+	inherit := func(opt *string, field string) {
+		if *opt == "" {
+			*opt = metadata[field]
+		}
+	}
+
+	inherit(&opts.FS, metadataFieldFS)
+	inherit(&opts.Partition, metadataFieldPartition)
+	inherit(&opts.Encrypted, metadataFieldEncrypted)
+	inherit(&opts.EncryptionKey, metadataFieldKeyRef)
+	if metadata[metadataFieldMode] == modeBlock {
+		inherit(&opts.Mode, metadataFieldMode)
+	}
+}
+
+// flushFilesystem flushes the filesystem of vol when it's mounted read-write on
+// this server, before Cinder copies the volume as is. Writes still being done
+// by containers might not be part of the copy.
+func (d *CinderDriver) flushFilesystem(logger *logrus.Entry, vol volumes.Volume) error {
+	mountpoint := path.Join(propagatedMount, vol.ID)
+	if mounted, err := isMounted(mountpoint); err != nil || !mounted {
+		return err
+	}
+
+	if readonly, err := d.isReadonly(vol); err != nil || readonly {
+		return err
+	}
+
+	logger.Warnf("Volume %s is mounted read-write, the copy might not be consistent.", vol.Name)
+
+	f, err := os.Open(mountpoint)
+	if err != nil {
+		return fmt.Errorf("opening %s: %v", mountpoint, err)
+	}
+	defer f.Close()
+
+	if err := unix.Syncfs(int(f.Fd())); err != nil {
+		return fmt.Errorf("flushing the filesystem of volume %s: %v", vol.Name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	tcs := []struct {
+		field    string
+		min, max int
+		expected []int
+		err      bool
+	}{
+		{field: "*", min: 0, max: 3, expected: []int{0, 1, 2, 3}},
+		{field: "*/2", min: 1, max: 7, expected: []int{1, 3, 5, 7}},
+		{field: "5", min: 0, max: 59, expected: []int{5}},
+		{field: "1-5/2", min: 0, max: 59, expected: []int{1, 3, 5}},
+		{field: "10/20", min: 0, max: 59, expected: []int{10, 30, 50}},
+		{field: "1,3-4", min: 0, max: 59, expected: []int{1, 3, 4}},
+		{field: "60", min: 0, max: 59, err: true},
+		{field: "5-1", min: 0, max: 59, err: true},
+		{field: "*/0", min: 0, max: 59, err: true},
+		{field: "a", min: 0, max: 59, err: true},
+		{field: "1-", min: 0, max: 59, err: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.field, func(t *testing.T) {
+			set, err := parseCronField(tc.field, tc.min, tc.max)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", set)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(set) != len(tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, set)
+			}
+			for _, v := range tc.expected {
+				if !set[v] {
+					t.Fatalf("expected %v, got %v", tc.expected, set)
+				}
+			}
+		})
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "* * * * * *", "@bogus", "* * 0 * *", "* * * 13 *", "* * * * 8"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("expected an error for %q", expr)
+		}
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tcs := []struct {
+		expr     string
+		time     string
+		expected bool
+	}{
+		{expr: "*/15 * * * *", time: "2026-10-13 10:30", expected: true},
+		{expr: "*/15 * * * *", time: "2026-10-13 10:31", expected: false},
+		{expr: "@daily", time: "2026-10-13 00:00", expected: true},
+		{expr: "@daily", time: "2026-10-13 01:00", expected: false},
+		{expr: "@monthly", time: "2026-10-01 00:00", expected: true},
+		// Both 0 and 7 stand for Sunday.
+		{expr: "0 3 * * 7", time: "2026-10-18 03:00", expected: true},
+		{expr: "0 3 * * 0", time: "2026-10-18 03:00", expected: true},
+		{expr: "0 3 * * 0", time: "2026-10-19 03:00", expected: false},
+		// When neither day field starts with *, either of them matching is
+		// enough.
+		{expr: "0 0 1 * 1", time: "2026-10-01 00:00", expected: true},
+		{expr: "0 0 1 * 1", time: "2026-10-12 00:00", expected: true},
+		{expr: "0 0 1 * 1", time: "2026-10-13 00:00", expected: false},
+		// Otherwise, both have to match.
+		{expr: "0 0 */2 * 1", time: "2026-10-13 00:00", expected: false},
+		{expr: "0 0 */2 * 1", time: "2026-10-12 00:00", expected: false},
+		{expr: "0 0 */2 * 1", time: "2026-10-05 00:00", expected: true},
+		{expr: "0 0 1 * */2", time: "2027-01-01 00:00", expected: false},
+		{expr: "0 0 1 * */2", time: "2026-10-01 00:00", expected: true},
+		{expr: "0 0 1 * */2", time: "2026-10-06 00:00", expected: false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.expr+" at "+tc.time, func(t *testing.T) {
+			c, err := parseCron(tc.expr)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := c.matches(at(tc.time)); got != tc.expected {
+				t.Fatalf("expected %t, got %t", tc.expected, got)
+			}
+		})
+	}
+}
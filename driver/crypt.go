@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/sirupsen/logrus"
+)
+
+// keySize is the size of the keys generated for new volumes when keys are
+// stored in KEY_DIR.
+const keySize = 64
+
+func isEncrypted(vol volumes.Volume) bool {
+	return vol.Metadata[metadataFieldEncrypted] == "true"
+}
+
+// mapperName is the name of the device-mapper device used to access the
+// decrypted content of vol.
+func mapperName(vol volumes.Volume) string {
+	return "cinder-" + vol.ID
+}
+
+func mapperPath(vol volumes.Volume) string {
+	return path.Join("/dev/mapper", mapperName(vol))
+}
+
+func isMapperOpen(vol volumes.Volume) (bool, error) {
+	if _, err := os.Stat(mapperPath(vol)); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("stat %s failed: %v", mapperPath(vol), err)
+	}
+
+	return true, nil
+}
+
+// validateKeyRef makes sure a key reference can be resolved by the configured
+// key source.
+func (d *CinderDriver) validateKeyRef(keyRef string) error {
+	if d.keyProviderCommand == "" && d.keyDir == "" {
+		return errors.New("encryption requires either KEY_DIR or KEY_PROVIDER_COMMAND to be set")
+	}
+	if d.keyProviderCommand == "" && (keyRef == "" || strings.Contains(keyRef, "/") || keyRef == "." || keyRef == "..") {
+		return fmt.Errorf("invalid encryption key reference %q", keyRef)
+	}
+
+	return nil
+}
+
+// readKey fetches the key referenced by keyRef. When keys are stored in
+// KEY_DIR and generate is true, a new key is created if it doesn't exist yet.
+func (d *CinderDriver) readKey(keyRef string, generate bool) ([]byte, error) {
+	if err := d.validateKeyRef(keyRef); err != nil {
+		return nil, err
+	}
+
+	if d.keyProviderCommand != "" {
+		args := append(strings.Fields(d.keyProviderCommand), keyRef)
+
+		var stderr bytes.Buffer
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stderr = &stderr
+
+		key, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("key provider command failed for key %s: %v: %s", keyRef, err, strings.TrimSpace(stderr.String()))
+		}
+		if len(key) == 0 {
+			return nil, fmt.Errorf("key provider command returned an empty key for key %s", keyRef)
+		}
+
+		return key, nil
+	}
+
+	keyFile := path.Join(d.keyDir, keyRef)
+
+	key, err := os.ReadFile(keyFile)
+	if err == nil {
+		return key, nil
+	} else if !os.IsNotExist(err) || !generate {
+		return nil, fmt.Errorf("reading key file %s: %v", keyFile, err)
+	}
+
+	key = make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generating key %s: %v", keyRef, err)
+	}
+
+	if err := os.WriteFile(keyFile, key, 0400); err != nil {
+		return nil, fmt.Errorf("writing key file %s: %v", keyFile, err)
+	}
+
+	return key, nil
+}
+
+// openEncrypted opens the LUKS container stored on dev, formatting it first if
+// dev is blank and init is true, and returns the path of the decrypted device.
+// With readonly, the container is opened in read-only mode.
+func (d *CinderDriver) openEncrypted(logger *logrus.Entry, vol volumes.Volume, dev string, init, readonly bool) (string, error) {
+	keyRef := vol.Metadata[metadataFieldKeyRef]
+
+	if open, err := isMapperOpen(vol); err != nil {
+		return "", err
+	} else if open {
+		// The volume might have been extended since the mapping was opened.
+		if err := refreshDeviceSize(dev, vol.Size); err != nil {
+			return "", err
+		}
+
+		key, err := d.readKey(keyRef, false)
+		if err != nil {
+			return "", err
+		}
+
+		if err := cryptsetup(key, "resize", mapperName(vol)); err != nil {
+			return "", err
+		}
+
+		return mapperPath(vol), nil
+	}
+
+	if err := exec.Command("cryptsetup", "isLuks", dev).Run(); err != nil {
+		blk, err := probeDevice(dev)
+		if err != nil {
+			return "", err
+		}
+		if blk.FSType != "" || blk.Children != nil || !init {
+			return "", fmt.Errorf("device %s should be encrypted but isn't a LUKS device", dev)
+		}
+
+		key, err := d.readKey(keyRef, true)
+		if err != nil {
+			return "", err
+		}
+
+		logger.Info("No LUKS header detected. Formatting...")
+
+		if err := cryptsetup(key, "luksFormat", "--batch-mode", "--type", "luks2", dev); err != nil {
+			return "", err
+		}
+	}
+
+	key, err := d.readKey(keyRef, false)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"open", dev, mapperName(vol)}
+	if readonly {
+		args = append(args, "--readonly")
+	}
+
+	if err := cryptsetup(key, args...); err != nil {
+		return "", err
+	}
+
+	return mapperPath(vol), nil
+}
+
+// closeEncrypted closes the mapping opened by openEncrypted, if any.
+func closeEncrypted(vol volumes.Volume) error {
+	if open, err := isMapperOpen(vol); err != nil || !open {
+		return err
+	}
+
+	if output, err := exec.Command("cryptsetup", "close", mapperName(vol)).CombinedOutput(); err != nil {
+		return fmt.Errorf("cryptsetup close %s failed: %v: %s", mapperName(vol), err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// cryptsetup runs cryptsetup with the given args, passing key on stdin.
+func cryptsetup(key []byte, args ...string) error {
+	args = append([]string{"--key-file", "-"}, args...)
+
+	cmd := exec.Command("cryptsetup", args...)
+	cmd.Stdin = bytes.NewReader(key)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cryptsetup %s failed: %v: %s", args[2], err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
@@ -2,22 +2,24 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
 	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/volumeattach"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
 	"github.com/opencontainers/selinux/go-selinux"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
@@ -27,23 +29,97 @@ const propagatedMount = "/var/lib/cinder"
 const metadataFieldUID = "docker-volume-driver:uid"
 const metadataFieldGID = "docker-volume-driver:gid"
 const metadataFieldMode = "docker-volume-driver:mode"
+const metadataFieldFS = "docker-volume-driver:fs"
+const metadataFieldMkfsOpts = "docker-volume-driver:mkfs-opts"
+const metadataFieldMountOpts = "docker-volume-driver:mount-opts"
+const metadataFieldFsck = "docker-volume-driver:fsck"
+const metadataFieldEncrypted = "docker-volume-driver:encrypted"
+const metadataFieldKeyRef = "docker-volume-driver:key-ref"
+const metadataFieldPartition = "docker-volume-driver:partition"
+const metadataFieldReadonly = "docker-volume-driver:readonly"
+const metadataFieldQuota = "docker-volume-driver:quota"
+const metadataFieldSnapshotSchedule = "docker-volume-driver:snapshot-schedule"
+const metadataFieldSnapshotKeep = "docker-volume-driver:snapshot-keep"
+const metadataFieldRemovePolicy = "docker-volume-driver:remove-policy"
+const metadataFieldAccess = "docker-volume-driver:access"
+
+// metadataFieldCinderReadonly is set by Cinder itself when the readonly flag of
+// a volume is set.
+const metadataFieldCinderReadonly = "readonly"
+
+// containerFileLabel is the SELinux label allowing containers to access files.
+const containerFileLabel = "system_u:object_r:container_file_t:s0"
+
+// DriverConfig holds the settings of the driver, as read from env vars.
+type DriverConfig struct {
+	Region       string
+	DefaultSize  int
+	VolumePrefix string
+	// FsckPolicy is used for volumes created without the fsck option.
+	FsckPolicy string
+	// RemovePolicy is used for volumes created without the remove_policy
+	// option.
+	RemovePolicy string
+	// StealPolicy tells whether volumes attached to other servers are
+	// detached from them before being mounted.
+	StealPolicy string
+	StateDir    string
+	// KeyDir is the directory where the keys of encrypted volumes are stored.
+	KeyDir string
+	// KeyProviderCommand is run with a key reference as last argument to get
+	// the key of an encrypted volume. It takes precedence over KeyDir.
+	KeyProviderCommand string
+	// Readonly is used for volumes created without the readonly option.
+	Readonly bool
+	// DeviceWaitTimeout bounds how long devices are waited for after
+	// attaching or detaching volumes.
+	DeviceWaitTimeout time.Duration
+	// Timeouts bound how long OpenStack operations are waited for.
+	Timeouts Timeouts
+	// IdleDetachTimeout is how long volumes stay attached after being
+	// unmounted. They're never detached when it's 0.
+	IdleDetachTimeout time.Duration
+}
 
 type CinderDriver struct {
 	storageClient *gophercloud.ServiceClient
 	computeClient *gophercloud.ServiceClient
+	imageClient   *gophercloud.ServiceClient
 	defaultSize   int
 	serverID      string
 	volumePrefix  string
+	fsckPolicy    string
+	removePolicy  string
+	stealPolicy   string
+	state         *stateStore
+	locks         *volumeLocks
+	// snapshotting holds the IDs of the volumes being snapshotted by the
+	// scheduler.
+	snapshotting sync.Map
+
+	keyDir             string
+	keyProviderCommand string
+	readonly           bool
+
+	devices           *deviceMonitor
+	deviceWaitTimeout time.Duration
+	timeouts          Timeouts
+	idleDetachTimeout time.Duration
 }
 
-func NewDriver(authOpts gophercloud.AuthOptions, region string, defaultSize int, volumePrefix string) (*CinderDriver, error) {
+func NewDriver(authOpts gophercloud.AuthOptions, cfg DriverConfig) (*CinderDriver, error) {
+	state, err := newStateStore(cfg.StateDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the local state: %v", err)
+	}
+
 	provider, err := openstack.AuthenticatedClient(authOpts)
 	if err != nil {
 		return nil, fmt.Errorf("could not create the provider client: %v", err)
 	}
 
 	endpointsOpts := gophercloud.EndpointOpts{
-		Region: region,
+		Region: cfg.Region,
 	}
 
 	storageClient, err := openstack.NewBlockStorageV3(provider, endpointsOpts)
@@ -56,6 +132,12 @@ func NewDriver(authOpts gophercloud.AuthOptions, region string, defaultSize int,
 		return nil, fmt.Errorf("could not create the compute v2 client: %v", err)
 	}
 
+	imageClient, err := openstack.NewImageServiceV2(provider, endpointsOpts)
+	if err != nil {
+		logrus.Warnf("Could not create the image service v2 client, volumes can't be created from images: %v", err)
+		imageClient = nil
+	}
+
 	serverID, err := getInstanceIDFromMetadataServer()
 	if err != nil {
 		return nil, fmt.Errorf("could not retrieve the ID of the OpenStack instance from metadata server: %v", err)
@@ -64,15 +146,30 @@ func NewDriver(authOpts gophercloud.AuthOptions, region string, defaultSize int,
 	d := &CinderDriver{
 		storageClient: storageClient,
 		computeClient: computeClient,
-		defaultSize:   defaultSize,
+		imageClient:   imageClient,
+		defaultSize:   cfg.DefaultSize,
 		serverID:      serverID,
-		volumePrefix:  volumePrefix,
+		volumePrefix:  cfg.VolumePrefix,
+		fsckPolicy:    cfg.FsckPolicy,
+		removePolicy:  cfg.RemovePolicy,
+		stealPolicy:   cfg.StealPolicy,
+		state:         state,
+		locks:         newVolumeLocks(),
+
+		keyDir:             cfg.KeyDir,
+		keyProviderCommand: cfg.KeyProviderCommand,
+		readonly:           cfg.Readonly,
+
+		devices:           newDeviceMonitor(),
+		deviceWaitTimeout: cfg.DeviceWaitTimeout,
+		timeouts:          cfg.Timeouts,
+		idleDetachTimeout: cfg.IdleDetachTimeout,
 	}
 
 	return d, nil
 }
 
-func (d *CinderDriver) Create(logger *logrus.Entry, req VolumeCreateReq) VolumeCreateResp {
+func (d *CinderDriver) Create(ctx context.Context, logger *logrus.Entry, req VolumeCreateReq) VolumeCreateResp {
 	resp := VolumeCreateResp{}
 
 	if !strings.HasPrefix(req.Name, d.volumePrefix) {
@@ -80,6 +177,83 @@ func (d *CinderDriver) Create(logger *logrus.Entry, req VolumeCreateReq) VolumeC
 		return resp
 	}
 
+	if req.Opts.Parent != "" {
+		if err := d.createSubVolume(logger, req); err != nil {
+			resp.Err = fmt.Sprintf("could not create sub-volume %s: %v", req.Name, err)
+			logger.Error(resp.Err)
+		}
+
+		return resp
+	}
+
+	sources := 0
+	for _, s := range []string{req.Opts.SnapshotID, req.Opts.BackupID, req.Opts.SourceVolume, req.Opts.SourceImage} {
+		if s != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		resp.Err = "only one of source_snapshot, source_backup, source_volume and source_image can be set"
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	var source volumes.Volume
+	if req.Opts.SourceVolume != "" {
+		var err error
+		if source, err = d.findSourceVolume(req.Opts.SourceVolume); err != nil {
+			resp.Err = err.Error()
+			logger.Error(resp.Err)
+
+			return resp
+		}
+
+		inheritSourceOpts(&req.Opts, source.Metadata)
+	}
+
+	// Snapshots and backups made through the plugin can be referred to by name.
+	sourceSize := source.Size
+	if req.Opts.SnapshotID != "" {
+		snap, err := d.findSnapshot(req.Opts.SnapshotID)
+		if err != nil {
+			resp.Err = err.Error()
+			logger.Error(resp.Err)
+
+			return resp
+		}
+
+		req.Opts.SnapshotID = snap.ID
+		sourceSize = snap.Size
+		inheritSourceOpts(&req.Opts, snap.Metadata)
+	}
+	if req.Opts.BackupID != "" {
+		backup, err := d.findBackup(req.Opts.BackupID)
+		if err != nil {
+			resp.Err = err.Error()
+			logger.Error(resp.Err)
+
+			return resp
+		}
+
+		req.Opts.BackupID = backup.ID
+		sourceSize = backup.Size
+		if backup.Metadata != nil {
+			inheritSourceOpts(&req.Opts, *backup.Metadata)
+		}
+	}
+
+	var img images.Image
+	if req.Opts.SourceImage != "" {
+		var err error
+		if img, err = d.findImage(req.Opts.SourceImage); err != nil {
+			resp.Err = err.Error()
+			logger.Error(resp.Err)
+
+			return resp
+		}
+	}
+
 	size := d.defaultSize
 	if req.Opts.Size != "" {
 		var err error
@@ -88,6 +262,151 @@ func (d *CinderDriver) Create(logger *logrus.Entry, req VolumeCreateReq) VolumeC
 			resp.Err = fmt.Sprintf("could not convert volume size (%s) from string to int: %v", req.Opts.Size, err)
 			logger.Error(resp.Err)
 
+			return resp
+		}
+	} else if sourceSize > size {
+		// Volumes can't be smaller than their source.
+		size = sourceSize
+	}
+	if img.ID != "" && req.Opts.Size == "" && imageMinSize(img) > size {
+		size = imageMinSize(img)
+	} else if img.ID != "" && imageMinSize(img) > size {
+		resp.Err = fmt.Sprintf("image %s requires volumes of at least %d GB", req.Opts.SourceImage, imageMinSize(img))
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	fsType := defaultFS
+	if req.Opts.FS != "" {
+		fsType = req.Opts.FS
+	}
+	if err := validateFS(fsType); err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+	if _, err := parseMkfsOpts(fsType, req.Opts.MkfsOpts); err != nil {
+		resp.Err = fmt.Sprintf("invalid mkfs_opts: %v", err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+	if req.Opts.Fsck != "" {
+		if err := validateFsckPolicy(req.Opts.Fsck); err != nil {
+			resp.Err = err.Error()
+			logger.Error(resp.Err)
+
+			return resp
+		}
+	}
+	if err := validatePartition(req.Opts.Partition); err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+	readonly := d.readonly
+	if req.Opts.Readonly != "" {
+		var err error
+		if readonly, err = strconv.ParseBool(req.Opts.Readonly); err != nil {
+			resp.Err = fmt.Sprintf("invalid readonly value %s: %v", req.Opts.Readonly, err)
+			logger.Error(resp.Err)
+
+			return resp
+		}
+	}
+	if _, _, err := parseMountOpts(fsType, req.Opts.MountOpts, readonly); err != nil {
+		resp.Err = fmt.Sprintf("invalid mount_opts: %v", err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+	if err := validateLabels(req.Opts.Labels); err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+	if req.Opts.RemovePolicy != "" {
+		if err := validateRemovePolicy(req.Opts.RemovePolicy); err != nil {
+			resp.Err = err.Error()
+			logger.Error(resp.Err)
+
+			return resp
+		}
+	}
+	if err := validateSnapshotSchedule(req.Opts.SnapshotSchedule, req.Opts.SnapshotKeep); err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+	if req.Opts.Quota != "" {
+		if err := validateQuota(fsType, req.Opts.Quota); err != nil {
+			resp.Err = err.Error()
+			logger.Error(resp.Err)
+
+			return resp
+		}
+		if req.Opts.Mode == modeBlock {
+			resp.Err = fmt.Sprintf("quotas can't be used in %s mode", modeBlock)
+			logger.Error(resp.Err)
+
+			return resp
+		}
+	}
+
+	multiattach := false
+	if req.Opts.Multiattach != "" {
+		var err error
+		if multiattach, err = strconv.ParseBool(req.Opts.Multiattach); err != nil {
+			resp.Err = fmt.Sprintf("invalid multiattach value %s: %v", req.Opts.Multiattach, err)
+			logger.Error(resp.Err)
+
+			return resp
+		}
+	}
+	if err := validateAccess(req.Opts.Access, multiattach, fsType, req.Opts.Mode); err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	// Volumes are multiattach when their type is.
+	volumeType := req.Opts.VolumeType
+	if multiattach {
+		var err error
+		if volumeType, err = d.multiattachVolumeType(volumeType); err != nil {
+			resp.Err = err.Error()
+			logger.Error(resp.Err)
+
+			return resp
+		}
+	}
+
+	encrypted := false
+	keyRef := ""
+	if req.Opts.Encrypted != "" {
+		var err error
+		if encrypted, err = strconv.ParseBool(req.Opts.Encrypted); err != nil {
+			resp.Err = fmt.Sprintf("invalid encrypted value %s: %v", req.Opts.Encrypted, err)
+			logger.Error(resp.Err)
+
+			return resp
+		}
+	}
+	if encrypted {
+		keyRef = req.Name
+		if req.Opts.EncryptionKey != "" {
+			keyRef = req.Opts.EncryptionKey
+		}
+		if err := d.validateKeyRef(keyRef); err != nil {
+			resp.Err = err.Error()
+			logger.Error(resp.Err)
+
 			return resp
 		}
 	}
@@ -100,15 +419,57 @@ func (d *CinderDriver) Create(logger *logrus.Entry, req VolumeCreateReq) VolumeC
 		Description:        req.Opts.Description,
 		SnapshotID:         req.Opts.SnapshotID,
 		BackupID:           req.Opts.BackupID,
-		VolumeType:         req.Opts.VolumeType,
+		SourceVolID:        source.ID,
+		ImageID:            img.ID,
+		VolumeType:         volumeType,
 		Metadata: map[string]string{
-			metadataFieldUID:  req.Opts.Uid,
-			metadataFieldGID:  req.Opts.Gid,
-			metadataFieldMode: req.Opts.Mode,
+			metadataFieldUID:       req.Opts.Uid,
+			metadataFieldGID:       req.Opts.Gid,
+			metadataFieldMode:      req.Opts.Mode,
+			metadataFieldFS:        fsType,
+			metadataFieldMkfsOpts:  req.Opts.MkfsOpts,
+			metadataFieldMountOpts: req.Opts.MountOpts,
+			metadataFieldFsck:      req.Opts.Fsck,
+			metadataFieldEncrypted: strconv.FormatBool(encrypted),
+			metadataFieldKeyRef:    keyRef,
+			metadataFieldPartition: req.Opts.Partition,
+			metadataFieldReadonly:  req.Opts.Readonly,
+			metadataFieldQuota:     req.Opts.Quota,
+
+			metadataFieldSnapshotSchedule: req.Opts.SnapshotSchedule,
+			metadataFieldSnapshotKeep:     req.Opts.SnapshotKeep,
+			metadataFieldRemovePolicy:     req.Opts.RemovePolicy,
+			metadataFieldAccess:           req.Opts.Access,
 		},
 	}
 
-	vol, err := volumes.Create(d.storageClient, opts).Extract()
+	for k, v := range req.Opts.Labels {
+		opts.Metadata[k] = v
+	}
+
+	if source.ID != "" {
+		if err := d.flushFilesystem(logger, source); err != nil {
+			resp.Err = err.Error()
+			logger.Error(resp.Err)
+
+			return resp
+		}
+	}
+
+	client := d.storageClient
+	if opts.BackupID != "" {
+		client = d.backupClient()
+		client.Microversion = createFromBackupMicroversion
+	}
+
+	if err := d.preflightCreate(logger, opts); err != nil {
+		resp.Err = fmt.Sprintf("could not create volume %s: %v", req.Name, err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	vol, err := volumes.Create(client, opts).Extract()
 	if err != nil {
 		resp.Err = fmt.Sprintf("could not create volume %s: %v", req.Name, err)
 		logger.Error(resp.Err)
@@ -116,7 +477,18 @@ func (d *CinderDriver) Create(logger *logrus.Entry, req VolumeCreateReq) VolumeC
 		return resp
 	}
 
-	if err := volumes.WaitForStatus(d.storageClient, vol.ID, "available", 60); err != nil {
+	// Copying an image or restoring a backup might take much longer than
+	// creating a blank volume, so Create returns right away and Mount fails
+	// until the volume is available.
+	if img.ID != "" {
+		logger.Infof("Volume %s is being created from image %s (%s).", req.Name, img.Name, img.ID)
+		return resp
+	} else if opts.BackupID != "" {
+		logger.Infof("Volume %s is being created from backup %s.", req.Name, opts.BackupID)
+		return resp
+	}
+
+	if err := d.waitForVolumeCreation(ctx, logger, vol, d.timeouts.Create); err != nil {
 		resp.Err = fmt.Sprintf("error waiting for volume creation to complete: %v", err)
 		logger.Error(resp.Err)
 
@@ -126,10 +498,10 @@ func (d *CinderDriver) Create(logger *logrus.Entry, req VolumeCreateReq) VolumeC
 	return resp
 }
 
-func (d *CinderDriver) Remove(logger *logrus.Entry, req VolumeRemoveReq) VolumeRemoveResp {
+func (d *CinderDriver) Remove(ctx context.Context, logger *logrus.Entry, req VolumeRemoveReq) VolumeRemoveResp {
 	resp := VolumeRemoveResp{}
 
-	vol, err := d.findVolume(req.Name)
+	vol, sub, err := d.lookupVolume(req.Name)
 	if err != nil {
 		resp.Err = err.Error()
 		logger.Error(resp.Err)
@@ -137,25 +509,64 @@ func (d *CinderDriver) Remove(logger *logrus.Entry, req VolumeRemoveReq) VolumeR
 		return resp
 	}
 
+	logger = logger.WithField("VolID", vol.ID)
+
+	unlock := d.locks.lock(vol.ID)
+	defer unlock()
+
+	if vol, sub, err = d.reloadVolume(vol, sub); err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	if sub != nil {
+		if err := d.removeSubVolume(logger, vol, *sub); err != nil {
+			resp.Err = err.Error()
+			logger.Error(resp.Err)
+		}
+
+		return resp
+	}
+
+	if subs, err := subVolumes(vol); err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	} else if len(subs) > 0 {
+		resp.Err = fmt.Sprintf("volume %s still has %d sub-volumes", req.Name, len(subs))
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
 	// Unmount() doesn't detach the volume from the server to make it faster to
 	// mount it again later. As such, if the volume isn't mounted but is attached,
 	// we have to detach it first.
-	mountpoint := path.Join(propagatedMount, vol.ID)
-	mounted, err := isMounted(mountpoint)
+	mountpoint, err := d.userMountpoint(vol)
 	if err != nil {
 		resp.Err = fmt.Sprintf("checking if volume is still mounted: %v", err)
 		logger.Error(resp.Err)
 
 		return resp
-	} else if err == nil && mounted {
+	} else if err == nil && mountpoint != "" {
 		resp.Err = "volume is still mounted"
 		logger.Error(resp.Err)
 
 		return resp
 	}
 
+	if err := closeEncrypted(vol); err != nil {
+		resp.Err = fmt.Sprintf("closing encrypted volume: %v", err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
 	if len(vol.Attachments) > 0 {
-		if err := d.detachVolume(logger, vol, false, true); err != nil {
+		if err := d.detachVolume(ctx, logger, vol, false, true); err != nil {
 			resp.Err = fmt.Sprintf("detaching volume from current server: %v", err)
 			logger.Error(resp.Err)
 
@@ -163,6 +574,33 @@ func (d *CinderDriver) Remove(logger *logrus.Entry, req VolumeRemoveReq) VolumeR
 		}
 	}
 
+	policy, err := d.volumeRemovePolicy(vol)
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	if policy != removeDelete {
+		retain := d.retainVolume
+		if policy == removeBackup {
+			retain = d.backUpAndDeleteVolume
+		}
+		if err := retain(logger, vol); err != nil {
+			resp.Err = fmt.Sprintf("failed to remove volume: %v", err)
+			logger.Error(resp.Err)
+
+			return resp
+		}
+
+		if err := d.state.remove(vol.ID); err != nil {
+			logger.Warnf("Could not remove the local state of volume %s: %v", req.Name, err)
+		}
+
+		return resp
+	}
+
 	osResp := volumes.Delete(d.storageClient, vol.ID, nil)
 	if err := osResp.ExtractErr(); err != nil {
 		resp.Err = fmt.Sprintf("failed to delete volume: %v", err)
@@ -171,18 +609,59 @@ func (d *CinderDriver) Remove(logger *logrus.Entry, req VolumeRemoveReq) VolumeR
 		return resp
 	}
 
-	err = d.waitForVolumeDeletion(vol.ID, 60)
+	err = d.waitForVolumeDeletion(ctx, vol.ID, d.timeouts.Delete)
 	if err != nil {
 		resp.Err = fmt.Sprintf("error waiting for volume deletion to complete: %v", err)
+		return resp
+	}
+
+	if err := d.state.remove(vol.ID); err != nil {
+		logger.Warnf("Could not remove the local state of volume %s: %v", req.Name, err)
 	}
 
 	return resp
 }
 
-func (d *CinderDriver) waitForVolumeDeletion(volID string, secs int) error {
+// waitForVolumeCreation waits for vol to be available. Volumes ending in error
+// status are deleted, so they're not left behind. Volumes still being created
+// when the client gives up or timeout expires are left alone, as they might just
+// be slow to create, e.g. when cloned. Errors getting vol are retried until
+// then, as they don't tell whether it has been created.
+func (d *CinderDriver) waitForVolumeCreation(ctx context.Context, logger *logrus.Entry, vol *volumes.Volume, timeout time.Duration) error {
+	failed := false
+	err := waitFor(ctx, timeout, func() (bool, error) {
+		v, err := volumes.Get(d.storageClient, vol.ID).Extract()
+		if err != nil {
+			logger.Warnf("Could not get volume %s while it's being created: %v", vol.Name, err)
+			return false, nil
+		}
+
+		if v.Status == "error" {
+			failed = true
+			return false, fmt.Errorf("volume is in %s status", v.Status)
+		}
+
+		return v.Status == "available", nil
+	})
+	if err == nil {
+		return nil
+	} else if !failed {
+		return fmt.Errorf("volume %s (%s) is still being created and has been left as is: %v", vol.Name, vol.ID, err)
+	}
+
+	logger.Warnf("Deleting volume %s, which failed to be created.", vol.Name)
+
+	if err := volumes.Delete(d.storageClient, vol.ID, nil).ExtractErr(); err != nil {
+		logger.Errorf("Could not delete volume %s in error status: %v", vol.Name, err)
+	}
+
+	return err
+}
+
+func (d *CinderDriver) waitForVolumeDeletion(ctx context.Context, volID string, timeout time.Duration) error {
 	url := d.storageClient.ServiceURL("volumes", volID)
 
-	return gophercloud.WaitFor(secs, func() (bool, error) {
+	return waitFor(ctx, timeout, func() (bool, error) {
 		ret, err := d.storageClient.Get(url, nil, nil)
 
 		if err != nil {
@@ -214,10 +693,10 @@ func (d *CinderDriver) findVolume(name string) (volumes.Volume, error) {
 	return volumes.Volume{}, errVolumeNotFound
 }
 
-func (d *CinderDriver) Mount(logger *logrus.Entry, req VolumeMountReq) VolumeMountResp {
+func (d *CinderDriver) Mount(ctx context.Context, logger *logrus.Entry, req VolumeMountReq) VolumeMountResp {
 	resp := VolumeMountResp{}
 
-	vol, err := d.findVolume(req.Name)
+	vol, sub, err := d.lookupVolume(req.Name)
 	if err != nil {
 		resp.Err = err.Error()
 		logger.Error(resp.Err)
@@ -227,125 +706,323 @@ func (d *CinderDriver) Mount(logger *logrus.Entry, req VolumeMountReq) VolumeMou
 
 	logger = logger.WithField("VolID", vol.ID)
 
-	var dev string // Device path (under /dev).
-	// Indicates whether the volume is already attached to the current server. It's used to not
-	// try to reattach the volume if it's already attached and save time.
-	var alreadyAttached bool
+	// Sub-volumes share the attachment and the filesystem of their parent, so
+	// they're serialized with it.
+	unlock := d.locks.lock(vol.ID)
+	defer unlock()
 
-	dev, err = findDevWithSerial(vol.ID)
-	if err != nil && err != errDeviceNotFound {
-		resp.Err = fmt.Sprintf("failed to probe if %s is already attached: %v", req.Name, err)
+	if vol, sub, err = d.reloadVolume(vol, sub); err != nil {
+		resp.Err = err.Error()
 		logger.Error(resp.Err)
 
 		return resp
-	} else if err == nil {
-		alreadyAttached = true
 	}
 
-	if vol.Multiattach == false && len(vol.Attachments) > 0 {
-		if err := d.detachVolume(logger, vol, true, false); err != nil {
+	if sub != nil {
+		resp.Mountpoint, err = d.mountSubVolume(ctx, logger, vol, *sub)
+		if err != nil {
 			resp.Err = err.Error()
 			logger.Error(resp.Err)
-
-			return resp
 		}
+
+		return resp
 	}
 
-	if !alreadyAttached {
-		dev, err = d.attachVolume(logger, vol)
-		if err != nil {
-			resp.Err = err.Error()
-			logger.Error(resp.Err)
+	resp.Mountpoint, err = d.mountVolume(ctx, logger, vol)
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
 
-			return resp
+		return resp
+	}
+
+	if err := d.state.update(vol.ID, func(st *volumeState) { st.InUse = true }); err != nil {
+		resp.Err = fmt.Sprintf("recording volume %s as mounted: %v", req.Name, err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	return resp
+}
+
+// mountVolume attaches vol to the current server and returns the path of its
+// datadir, or of its block device in block mode.
+func (d *CinderDriver) mountVolume(ctx context.Context, logger *logrus.Entry, vol volumes.Volume) (string, error) {
+	if err := checkVolumeReady(vol); err != nil {
+		return "", err
+	}
+
+	readonly, err := d.isReadonly(vol)
+	if err != nil {
+		return "", err
+	}
+
+	dev, noReplay, err := d.attachDevice(ctx, logger, vol, readonly)
+	if err != nil {
+		return "", err
+	}
+
+	// Only one server at a time mounts shared volumes in read-write mode.
+	if isShared(vol) && !readonly {
+		if readonly, err = d.sharedReadonly(logger, vol); err != nil {
+			return "", err
 		}
+		noReplay = readonly
+	}
+
+	if dev, err = d.openDevice(logger, vol, dev, !readonly, readonly); err != nil {
+		return "", fmt.Errorf("failed to open volume %s: %v", vol.Name, err)
 	}
 
 	logger = logger.WithField("Device", dev)
 
-	if fsDetected, err := isExt4(dev); err != nil {
-		resp.Err = err.Error()
-		logger.Error(resp.Err)
+	if isBlockMode(vol) {
+		return exposeBlockDevice(vol, dev)
+	}
 
-		return resp
-	} else if !fsDetected {
-		logger.Info("No filesystem detected. Formatting...")
+	return d.mountFilesystem(logger, vol, dev, readonly, noReplay)
+}
 
-		if err := d.format(dev); err != nil {
-			resp.Err = err.Error()
-			logger.Error(resp.Err)
+// attachDevice attaches vol to the current server, unless it's already
+// attached, and returns the disk it's attached as. It also returns whether
+// other servers might be writing to the disk while it's mounted in read-only
+// mode, in which case its journal mustn't be replayed.
+func (d *CinderDriver) attachDevice(ctx context.Context, logger *logrus.Entry, vol volumes.Volume, readonly bool) (string, bool, error) {
+	dev, err := findDevWithSerial(vol.ID)
+	if err != nil && err != errDeviceNotFound {
+		return "", false, fmt.Errorf("failed to probe if %s is already attached: %v", vol.Name, err)
+	}
+	// The volume is already attached to the current server, don't try to
+	// reattach it to save time.
+	alreadyAttached := err == nil
 
-			return resp
+	if !canShareAttachment(vol, readonly) && len(vol.Attachments) > 0 {
+		if err := d.checkSteal(logger, vol); err != nil {
+			return "", false, err
+		}
+		if err := d.detachVolume(ctx, logger, vol, true, false); err != nil {
+			return "", false, err
+		}
+	}
+
+	writtenElsewhere := readonly && isAttachedElsewhere(vol, d.serverID)
+
+	if alreadyAttached {
+		return dev, writtenElsewhere, nil
+	}
+
+	// Cinder only updates the flag of available volumes, so the disk of
+	// volumes attached to other servers is writable.
+	if err := d.setReadonlyFlag(vol, readonly); err != nil && readonly {
+		logger.Warnf("Could not set the readonly flag of volume %s, it's attached in read-write mode and its journal won't be replayed: %v", vol.Name, err)
+		writtenElsewhere = true
+	} else if err != nil {
+		logger.Warnf("Could not update the readonly flag of the volume, the attachment mode won't match: %v", err)
+	}
+
+	dev, err = d.attachVolume(ctx, logger, vol)
+	if err != nil {
+		return "", false, err
+	}
+
+	return dev, writtenElsewhere, nil
+}
+
+// mountFilesystem mounts the filesystem stored on dev, formatting it first if
+// needed, and returns the path of its datadir.
+func (d *CinderDriver) mountFilesystem(logger *logrus.Entry, vol volumes.Volume, dev string, readonly, noReplay bool) (string, error) {
+	fsType, err := getFSMetadata(vol)
+	if err != nil {
+		return "", err
+	}
+
+	fsDetected, err := isFormatted(dev, fsType)
+	if err != nil {
+		return "", err
+	} else if !fsDetected && filesystems[fsType].cluster {
+		return "", fmt.Errorf("volume %s has no %s filesystem, cluster filesystems have to be formatted beforehand", vol.Name, fsType)
+	} else if !fsDetected && readonly {
+		return "", fmt.Errorf("volume %s is read-only but has no filesystem", vol.Name)
+	} else if !fsDetected {
+		logger.Infof("No filesystem detected. Formatting with %s...", fsType)
+
+		if err := d.format(dev, fsType, vol.Metadata[metadataFieldMkfsOpts]); err != nil {
+			return "", err
 		}
 	}
 
 	mountpoint := path.Join(propagatedMount, vol.ID)
 	logger = logger.WithField("mountpoint", mountpoint)
 
-	if mounted, err := isMounted(mountpoint); err != nil {
-		resp.Err = fmt.Sprintf("checking if dev is already mounted: %v", err)
-		logger.Error(resp.Err)
-
-		return resp
+	if mounted, err := isMounted(mountpoint); err != nil {
+		return "", fmt.Errorf("checking if dev is already mounted: %v", err)
 	} else if !mounted {
+		// There's no point in checking a filesystem that was just created, nor
+		// one another server might be writing to.
+		if fsDetected && !noReplay {
+			if err := d.checkFS(logger, vol, dev, fsType); err != nil {
+				return "", fmt.Errorf("refusing to mount volume %s: %v", vol.Name, err)
+			}
+		}
+
+		mountOpts := vol.Metadata[metadataFieldMountOpts]
+		if quota, err := needsProjectQuota(vol); err != nil {
+			return "", err
+		} else if quota && !readonly {
+			if err := enableProjectQuota(logger, dev, fsType); err != nil {
+				return "", fmt.Errorf("failed to enable quotas on volume %s: %v", vol.Name, err)
+			}
+			mountOpts = strings.TrimPrefix(mountOpts+",prjquota", ",")
+		}
+
 		logger.Debug("Mounting the filesystem...")
-		if err := d.mount(dev, mountpoint); err != nil {
-			resp.Err = fmt.Sprintf("failed to mount volume %s: %v", req.Name, err)
-			logger.Error(resp.Err)
+		if err := d.mount(dev, mountpoint, fsType, mountOpts, readonly, noReplay); err != nil {
+			return "", fmt.Errorf("failed to mount volume %s: %v", vol.Name, err)
+		}
+	}
 
-			return resp
+	// The volume might have been extended while it wasn't mounted, or out-of-band.
+	if !readonly {
+		if err := growIfNeeded(logger, dev, mountpoint, fsType, vol.Size); err != nil {
+			logger.Warnf("Could not grow the filesystem: %v", err)
 		}
 	}
 
 	// rexray/cinder uses the data subfolder as mountpoint, so we need to do the same to be compatible.
 	datadir := path.Join(mountpoint, "data")
 	if _, err := os.Stat(datadir); err != nil && !os.IsNotExist(err) {
-		resp.Err = fmt.Sprintf("stat %s failed: %v", datadir, err)
-		logger.Error(resp.Err)
-
-		return resp
+		return "", fmt.Errorf("stat %s failed: %v", datadir, err)
+	} else if os.IsNotExist(err) && readonly {
+		return "", fmt.Errorf("volume %s is read-only but has no data directory", vol.Name)
 	} else if os.IsNotExist(err) {
 		uid, gid, mode, err := getPermsMetadata(vol)
 		if err != nil {
-			resp.Err = err.Error()
-			logger.Error(resp.Err)
-
-			return resp
+			return "", err
 		}
 
 		logger.Debugf("Create the datadir with filemode and perms: %#o %d:%d.", mode, uid, gid)
 
 		if err := os.Mkdir(datadir, os.FileMode(mode)); err != nil {
-			resp.Err = err.Error()
-			logger.Error(resp.Err)
-
-			return resp
+			return "", err
 		}
 		if err := os.Chown(datadir, uid, gid); err != nil {
-			resp.Err = err.Error()
-			logger.Error(resp.Err)
-
-			return resp
+			return "", err
 		}
 	}
 
-	if selinux.GetEnabled() {
+	// Read-only filesystems are labeled through a mount option instead.
+	if selinux.GetEnabled() && !readonly {
 		logger.Debugf("Set SELinux context for datadir")
-		context := "system_u:object_r:container_file_t:s0"
-		if err := selinux.SetFileLabel(datadir, context); err != nil {
-			resp.Err = err.Error()
-			logger.Error(resp.Err)
+		if err := selinux.SetFileLabel(datadir, containerFileLabel); err != nil {
+			return "", err
+		}
+	}
 
-			return resp
+	// The quota is applied on each mount to pick up volumes whose datadir
+	// doesn't have its project yet, e.g. volumes created from a snapshot of a
+	// volume without quota.
+	if quota := vol.Metadata[metadataFieldQuota]; quota != "" && !readonly {
+		limit, err := parseQuota(quota)
+		if err != nil {
+			return "", fmt.Errorf("reading %s: %v", metadataFieldQuota, err)
+		}
+
+		logger.Debugf("Limit the datadir to %d bytes.", limit)
+		if err := setProjectQuota(mountpoint, datadir, fsType, datadirProject, limit); err != nil {
+			return "", fmt.Errorf("failed to set the quota of volume %s: %v", vol.Name, err)
 		}
 	}
 
-	resp.Mountpoint = datadir
+	return datadir, nil
+}
+
+// openDevice returns the device holding the filesystem of vol, given the disk
+// it's attached as. That's either the disk itself, one of its partitions or a
+// LUKS mapping. When init is true, the partition table and the LUKS header are
+// created on blank disks. readonly is whether vol is to be used in read-only
+// mode, which might differ from its readonly option, e.g. for shared volumes.
+func (d *CinderDriver) openDevice(logger *logrus.Entry, vol volumes.Volume, disk string, init, readonly bool) (string, error) {
+	dev := disk
 
-	return resp
+	if vol.Metadata[metadataFieldPartition] != "" {
+		var err error
+		if dev, err = d.resolvePartition(logger, vol, disk, init); err != nil {
+			return "", err
+		}
+	}
+
+	if isEncrypted(vol) {
+		return d.openEncrypted(logger, vol, dev, init, readonly)
+	}
+
+	return dev, nil
+}
+
+func (d *CinderDriver) isReadonly(vol volumes.Volume) (bool, error) {
+	v, ok := vol.Metadata[metadataFieldReadonly]
+	if !ok || v == "" {
+		return d.readonly, nil
+	}
+
+	readonly, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("reading %s: %v", metadataFieldReadonly, err)
+	}
+
+	return readonly, nil
+}
+
+// setReadonlyFlag updates the readonly flag of vol in Cinder, which makes Nova
+// attach it in read-only mode. This is only possible while vol is detached.
+func (d *CinderDriver) setReadonlyFlag(vol volumes.Volume, readonly bool) error {
+	if strings.EqualFold(vol.Metadata[metadataFieldCinderReadonly], "true") == readonly {
+		return nil
+	}
+
+	url := d.storageClient.ServiceURL("volumes", vol.ID, "action")
+	body := map[string]interface{}{
+		"os-update_readonly_flag": map[string]interface{}{
+			"readonly": readonly,
+		},
+	}
+
+	_, err := d.storageClient.Post(url, body, nil, &gophercloud.RequestOpts{
+		OkCodes: []int{202},
+	})
+
+	return err
+}
+
+// updateMetadata sets the given metadata keys of a volume, leaving other keys
+// untouched.
+func (d *CinderDriver) updateMetadata(volID string, metadata map[string]string) error {
+	url := d.storageClient.ServiceURL("volumes", volID, "metadata")
+	body := map[string]interface{}{
+		"metadata": metadata,
+	}
+
+	_, err := d.storageClient.Post(url, body, nil, &gophercloud.RequestOpts{
+		OkCodes: []int{200},
+	})
+
+	return err
+}
+
+func (d *CinderDriver) deleteMetadata(volID, key string) error {
+	url := d.storageClient.ServiceURL("volumes", volID, "metadata", key)
+
+	_, err := d.storageClient.Delete(url, &gophercloud.RequestOpts{
+		OkCodes: []int{200},
+	})
+
+	return err
 }
 
-func (d *CinderDriver) attachVolume(logger *logrus.Entry, vol volumes.Volume) (string, error) {
+func (d *CinderDriver) attachVolume(ctx context.Context, logger *logrus.Entry, vol volumes.Volume) (string, error) {
+	events := d.devices.subscribe()
+	defer d.devices.unsubscribe(events)
+
 	att, err := volumeattach.Create(d.computeClient, d.serverID, &volumeattach.CreateOpts{
 		VolumeID: vol.ID,
 	}).Extract()
@@ -353,7 +1030,10 @@ func (d *CinderDriver) attachVolume(logger *logrus.Entry, vol volumes.Volume) (s
 		return "", fmt.Errorf("failed to attach volume %s: %v", vol.Name, err)
 	}
 
-	if err := d.waitForVolumeAttachStatus(att.VolumeID, att.ServerID, true, 60*time.Second); err != nil {
+	if err := d.waitForVolumeAttachStatus(ctx, att.VolumeID, att.ServerID, true, d.timeouts.Attach); err != nil {
+		if ctx.Err() != nil {
+			d.rollbackAttachment(logger, vol)
+		}
 		return "", fmt.Errorf("error waiting for volume %s to be attached: %v", vol.Name, err)
 	}
 
@@ -367,14 +1047,44 @@ func (d *CinderDriver) attachVolume(logger *logrus.Entry, vol volumes.Volume) (s
 	// The only way to actually know what device name is assigned to a Block Storage disk is to read the serial
 	// number of disks attached to the instance and find the one matching the UUID of the Block Storage volume.
 	//
-	// The plugin might try to read the udev file for the newly attached disk before the kernel make it available,
-	// so better wait a bit before reading it.
-	time.Sleep(200 * time.Millisecond)
+	// The disk shows up some time after Nova reports the volume as attached, and udev then needs to process it
+	// before its serial can be read.
+	dev, err := d.devices.waitForDevice(ctx, events, att.VolumeID, d.deviceWaitTimeout)
+	if err != nil {
+		if ctx.Err() != nil {
+			d.rollbackAttachment(logger, vol)
+		}
+		return "", fmt.Errorf("waiting for the device of volume %s: %v", vol.Name, err)
+	}
+
+	return dev, nil
+}
+
+// rollbackAttachment detaches vol from the current server once it's attached,
+// after the client gave up on mounting it. Retrying the mount then starts from
+// scratch, instead of finding the volume attached but not mounted. Nova can't
+// detach volumes still being attached, hence the wait.
+func (d *CinderDriver) rollbackAttachment(logger *logrus.Entry, vol volumes.Volume) {
+	ctx := context.Background()
+
+	logger.Warnf("The client gave up on mounting volume %s, detaching it.", vol.Name)
 
-	return findDevWithSerial(att.VolumeID)
+	if err := d.waitForVolumeAttachStatus(ctx, vol.ID, d.serverID, true, d.timeouts.Attach); err != nil {
+		logger.Errorf("Could not roll back the attachment of volume %s: %v", vol.Name, err)
+		return
+	}
+
+	if err := volumeattach.Delete(d.computeClient, d.serverID, vol.ID).ExtractErr(); err != nil {
+		logger.Errorf("Could not roll back the attachment of volume %s: %v", vol.Name, err)
+		return
+	}
+
+	if err := d.waitForVolumeAttachStatus(ctx, vol.ID, d.serverID, false, d.timeouts.Detach); err != nil {
+		logger.Errorf("Could not roll back the attachment of volume %s: %v", vol.Name, err)
+	}
 }
 
-func (d *CinderDriver) detachVolume(logger *logrus.Entry, vol volumes.Volume, skipCurrent, onlyCurrent bool) error {
+func (d *CinderDriver) detachVolume(ctx context.Context, logger *logrus.Entry, vol volumes.Volume, skipCurrent, onlyCurrent bool) error {
 	for _, att := range vol.Attachments {
 		if skipCurrent && att.ServerID == d.serverID {
 			continue
@@ -383,23 +1093,37 @@ func (d *CinderDriver) detachVolume(logger *logrus.Entry, vol volumes.Volume, sk
 			continue
 		}
 
+		var events chan uevent
+		if att.ServerID == d.serverID {
+			events = d.devices.subscribe()
+			defer d.devices.unsubscribe(events)
+		}
+
 		r := volumeattach.Delete(d.computeClient, att.ServerID, vol.ID)
 		if err := r.ExtractErr(); err != nil {
 			return fmt.Errorf("could not detach volume %s from server %s: %v", vol.Name, att.ServerID, err)
 		}
 
-		if err := d.waitForVolumeAttachStatus(att.VolumeID, att.ServerID, false, 60*time.Second); err != nil {
+		if err := d.waitForVolumeAttachStatus(ctx, att.VolumeID, att.ServerID, false, d.timeouts.Detach); err != nil {
 			return fmt.Errorf("error waiting for volume %s to be detached from server %s: %v", vol.Name, att.ServerID, err)
 		}
 
+		// The device might linger for a bit, and be found again by the next
+		// attachment.
+		if events != nil {
+			if err := d.devices.waitForDeviceRemoval(ctx, events, vol.ID, d.deviceWaitTimeout); err != nil {
+				logger.Warnf("The device of volume %s is still present after detaching it: %v", vol.Name, err)
+			}
+		}
+
 		logger.Debugf("Volume %s has been detached from server %s.", vol.Name, att.ServerID)
 	}
 
 	return nil
 }
 
-func (d *CinderDriver) waitForVolumeAttachStatus(volID, serverID string, attachmentNeeded bool, timeout time.Duration) error {
-	return gophercloud.WaitFor(int(timeout.Seconds()), func() (bool, error) {
+func (d *CinderDriver) waitForVolumeAttachStatus(ctx context.Context, volID, serverID string, attachmentNeeded bool, timeout time.Duration) error {
+	return waitFor(ctx, timeout, func() (bool, error) {
 		vol, err := volumes.Get(d.storageClient, volID).Extract()
 
 		if err != nil {
@@ -424,100 +1148,48 @@ func (d *CinderDriver) waitForVolumeAttachStatus(volID, serverID string, attachm
 	})
 }
 
-func (d *CinderDriver) mount(dev, mountpoint string) error {
-	if err := os.MkdirAll(mountpoint, 0750); err != nil {
-		return fmt.Errorf("failed to create mountpoint directory %s: %v", mountpoint, err)
-	}
-
-	mountFlags := uintptr(unix.MS_RELATIME)
-	if err := unix.Mount(dev, mountpoint, "ext4", mountFlags, ""); err != nil {
-		return fmt.Errorf("mount syscall failed: %v", err)
-	}
-
-	return nil
-}
-
-func (d *CinderDriver) format(dev string) error {
-	if err := exec.Command("mkfs.ext4", "-F", dev).Run(); err != nil {
-		return fmt.Errorf("mkfs.ext4 on %s failed: %v", dev, err)
+func getPermsMetadata(vol volumes.Volume) (int, int, int, error) {
+	uid, gid, mode, err := parsePerms(vol.Metadata[metadataFieldUID], vol.Metadata[metadataFieldGID], vol.Metadata[metadataFieldMode])
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("reading permissions metadata: %v", err)
 	}
 
-	return nil
+	return uid, gid, mode, nil
 }
 
-func getPermsMetadata(vol volumes.Volume) (int, int, int, error) {
+// parsePerms parses the uid, gid and mode options of a volume, falling back to
+// 0:0 and 0750 when they're empty.
+func parsePerms(uidOpt, gidOpt, modeOpt string) (int, int, int, error) {
 	var err error
 
 	uid := 0
-	if v, ok := vol.Metadata[metadataFieldUID]; ok && v != "" {
-		if uid, err = strconv.Atoi(v); err != nil {
-			err = fmt.Errorf("reading %s: %v", metadataFieldUID, err)
-			return 0, 0, 0, err
+	if uidOpt != "" {
+		if uid, err = strconv.Atoi(uidOpt); err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid uid %s: %v", uidOpt, err)
 		}
 	}
 
 	gid := 0
-	if v, ok := vol.Metadata[metadataFieldGID]; ok && v != "" {
-		if gid, err = strconv.Atoi(v); err != nil {
-			err = fmt.Errorf("reading %s: %v", metadataFieldGID, err)
-			return 0, 0, 0, err
+	if gidOpt != "" {
+		if gid, err = strconv.Atoi(gidOpt); err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid gid %s: %v", gidOpt, err)
 		}
 	}
 
 	mode := 0750
-	if v, ok := vol.Metadata[metadataFieldMode]; ok && v != "" {
-		if mode, err = strconv.Atoi(v); err != nil {
-			err = fmt.Errorf("reading %s: %v", metadataFieldMode, err)
-			return 0, 0, 0, err
+	if modeOpt != "" {
+		if mode, err = strconv.Atoi(modeOpt); err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid mode %s: %v", modeOpt, err)
 		}
 	}
 
 	return uid, gid, mode, nil
 }
 
-func isExt4(dev string) (bool, error) {
-	output, err := exec.Command("lsblk", "--json", "--output", "NAME,FSTYPE", dev).Output()
-	if err != nil {
-		return false, fmt.Errorf("listing block devices failed: %v", err)
-	}
-
-	type device struct {
-		Name     string   `json:"name"`
-		FSType   string   `json:"fstype,omitempty"`
-		Children []device `json:"children,omitempty"`
-	}
-
-	var result struct {
-		Blockdevices []device `json:"blockdevices"`
-	}
-
-	if err := json.Unmarshal(output, &result); err != nil {
-		return false, fmt.Errorf("parsing block devices failed: %v", err)
-	}
-
-	if len(result.Blockdevices) < 1 {
-		return false, fmt.Errorf("device %s not found", dev)
-	}
-
-	d := result.Blockdevices[0]
-
-	if d.FSType == "ext4" {
-		return true, nil
-	}
-
-	if d.Children != nil {
-		return false, fmt.Errorf("device %s has a partition table", dev)
-	} else if d.FSType != "" {
-		return false, fmt.Errorf("device %s has a %s filesystem", dev, d.FSType)
-	}
-
-	return false, nil
-}
-
-func (d *CinderDriver) Path(logger *logrus.Entry, req VolumePathReq) VolumePathResp {
+func (d *CinderDriver) Path(ctx context.Context, logger *logrus.Entry, req VolumePathReq) VolumePathResp {
 	resp := VolumePathResp{}
 
-	vol, err := d.findVolume(req.Name)
+	vol, sub, err := d.lookupVolume(req.Name)
 	if err != nil {
 		resp.Err = err.Error()
 		logger.Error(resp.Err)
@@ -527,25 +1199,30 @@ func (d *CinderDriver) Path(logger *logrus.Entry, req VolumePathReq) VolumePathR
 
 	logger = logger.WithField("VolID", vol.ID)
 
-	mountpoint := path.Join(propagatedMount, vol.ID)
-	if ok, err := isMounted(mountpoint); err != nil {
+	var mountpoint string
+	if sub != nil {
+		mountpoint, err = subVolumeMountpoint(*sub)
+	} else {
+		mountpoint, err = d.userMountpoint(vol)
+	}
+	if err != nil {
 		resp.Err = fmt.Sprintf("checking if volume %s is already mounted: %v", req.Name, err)
 		logger.Error(resp.Err)
 
 		return resp
-	} else if !ok {
+	} else if mountpoint == "" {
 		resp.Err = "volume not mounted"
 		return resp
 	}
 
-	resp.Mountpoint = path.Join(mountpoint, "data")
+	resp.Mountpoint = mountpoint
 	return resp
 }
 
-func (d *CinderDriver) Unmount(logger *logrus.Entry, req VolumeUnmountReq) VolumeUnmountResp {
+func (d *CinderDriver) Unmount(ctx context.Context, logger *logrus.Entry, req VolumeUnmountReq) VolumeUnmountResp {
 	resp := VolumeUnmountResp{}
 
-	vol, err := d.findVolume(req.Name)
+	vol, sub, err := d.lookupVolume(req.Name)
 	if err != nil {
 		resp.Err = err.Error()
 		logger.Error(resp.Err)
@@ -555,54 +1232,179 @@ func (d *CinderDriver) Unmount(logger *logrus.Entry, req VolumeUnmountReq) Volum
 
 	logger = logger.WithField("VolID", vol.ID)
 
-	mountpoint := path.Join(propagatedMount, vol.ID)
-	if ok, err := isMounted(mountpoint); err != nil {
+	unlock := d.locks.lock(vol.ID)
+	defer unlock()
+
+	if vol, sub, err = d.reloadVolume(vol, sub); err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	if sub != nil {
+		if err := d.unmountSubVolume(logger, vol, *sub); err != nil {
+			resp.Err = err.Error()
+			logger.Error(resp.Err)
+
+			return resp
+		}
+
+		d.recordUnmount(logger, vol)
+
+		return resp
+	}
+
+	if active, err := d.userMountpoint(vol); err != nil {
 		resp.Err = fmt.Sprintf("checking if volume %s is already mounted: %v", req.Name, err)
 		logger.Error(resp.Err)
 
 		return resp
-	} else if !ok {
+	} else if active == "" {
 		resp.Err = fmt.Sprintf("volume %s is not mounted", req.Name)
 		return resp
 	}
 
-	if err := unix.Unmount(mountpoint, 0); err != nil {
-		resp.Err = fmt.Sprintf("unmounting volume %s: %v", req.Name, err)
+	if isBlockMode(vol) {
+		mountpoint := path.Join(propagatedMount, vol.ID)
+		if err := os.Remove(path.Join(mountpoint, blockDeviceLink)); err != nil {
+			resp.Err = fmt.Sprintf("removing the device link of volume %s: %v", req.Name, err)
+			logger.Error(resp.Err)
+
+			return resp
+		}
+
+		if err := os.Remove(mountpoint); err != nil {
+			logger.Errorf("failed to remove mountpoint directory %s after unmount: %v", mountpoint, err)
+		}
+
+		if err := closeEncrypted(vol); err != nil {
+			resp.Err = fmt.Sprintf("closing encrypted volume %s: %v", req.Name, err)
+			logger.Error(resp.Err)
+
+			return resp
+		}
+
+		if err := d.state.update(vol.ID, func(st *volumeState) {
+			st.InUse = false
+			st.LastUnmount = time.Now().UTC()
+		}); err != nil {
+			resp.Err = fmt.Sprintf("recording volume %s as unmounted: %v", req.Name, err)
+			logger.Error(resp.Err)
+
+			return resp
+		}
+
+		return resp
+	}
+
+	if err := d.state.update(vol.ID, func(st *volumeState) {
+		st.InUse = false
+		st.LastUnmount = time.Now().UTC()
+	}); err != nil {
+		resp.Err = fmt.Sprintf("recording volume %s as unmounted: %v", req.Name, err)
 		logger.Error(resp.Err)
 
 		return resp
 	}
 
-	if err := os.Remove(mountpoint); err != nil {
-		logger.Error("failed to remove mountpoint directory %s after unmount: %v", mountpoint, err)
+	if err := d.releaseFilesystem(logger, vol); err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
 	}
 
 	// We don't try to detach the volume from the server to save time
-	// if the next mount happens on the same server.
+	// if the next mount happens on the same server. The reaper detaches it
+	// once it has been idle for IDLE_DETACH_TIMEOUT.
 
 	return resp
 }
 
+// releaseFilesystem unmounts the filesystem of vol once neither vol nor its
+// sub-volumes are mounted anymore.
+func (d *CinderDriver) releaseFilesystem(logger *logrus.Entry, vol volumes.Volume) error {
+	if d.state.get(vol.ID).InUse {
+		return nil
+	}
+
+	if count, err := mountedSubVolumes(vol); err != nil {
+		return fmt.Errorf("checking if sub-volumes of %s are mounted: %v", vol.Name, err)
+	} else if count > 0 {
+		logger.Debugf("Keeping the filesystem mounted for %d sub-volumes.", count)
+		return nil
+	}
+
+	mountpoint := path.Join(propagatedMount, vol.ID)
+	if err := unix.Unmount(mountpoint, 0); err != nil {
+		return fmt.Errorf("unmounting volume %s: %v", vol.Name, err)
+	}
+
+	if err := os.Remove(mountpoint); err != nil {
+		logger.Errorf("failed to remove mountpoint directory %s after unmount: %v", mountpoint, err)
+	}
+
+	if err := closeEncrypted(vol); err != nil {
+		return fmt.Errorf("closing encrypted volume %s: %v", vol.Name, err)
+	}
+
+	if err := d.releaseWriterLease(vol); err != nil {
+		logger.Warnf("Could not release the writer lease of volume %s: %v", vol.Name, err)
+	}
+
+	return nil
+}
+
+// userMountpoint returns the path handed to Podman for vol, or an empty string
+// when vol isn't mounted on this server.
+func (d *CinderDriver) userMountpoint(vol volumes.Volume) (string, error) {
+	mountpoint := path.Join(propagatedMount, vol.ID)
+
+	if isBlockMode(vol) {
+		link := path.Join(mountpoint, blockDeviceLink)
+		if _, err := os.Lstat(link); os.IsNotExist(err) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+
+		return link, nil
+	}
+
+	if ok, err := isMounted(mountpoint); err != nil || !ok {
+		return "", err
+	}
+
+	// The filesystem might only be mounted for the sub-volumes of vol. Volumes
+	// mounted before their state was tracked have no sub-volume mounted.
+	if !d.state.get(vol.ID).InUse {
+		if count, err := mountedSubVolumes(vol); err != nil || count > 0 {
+			return "", err
+		}
+	}
+
+	return path.Join(mountpoint, "data"), nil
+}
+
 func isMounted(expectedMountpoint string) (bool, error) {
 	mounts, err := listMounts()
 	if err != nil {
 		return false, fmt.Errorf("checking if a device is mounted on %s: %v", expectedMountpoint, err)
 	}
 
-	for _, mountpoint := range mounts {
-		if mountpoint == expectedMountpoint {
-			return true, nil
-		}
-	}
-
-	return false, nil
+	_, ok := mounts[expectedMountpoint]
+	return ok, nil
 }
 
+// listMounts returns the devices mounted under propagatedMount, indexed by
+// mountpoint. A device can be mounted several times, e.g. by bind mounts.
 func listMounts() (map[string]string, error) {
 	f, err := os.Open("/proc/mounts")
 	if err != nil {
 		return map[string]string{}, fmt.Errorf("opening /proc/mounts: %v", err)
 	}
+	defer f.Close()
 
 	mounts := map[string]string{}
 
@@ -614,16 +1416,16 @@ func listMounts() (map[string]string, error) {
 			continue
 		}
 
-		mounts[w[0]] = w[1]
+		mounts[w[1]] = w[0]
 	}
 
-	return mounts, nil
+	return mounts, scanner.Err()
 }
 
-func (d *CinderDriver) Get(logger *logrus.Entry, req VolumeGetReq) VolumeGetResp {
+func (d *CinderDriver) Get(ctx context.Context, logger *logrus.Entry, req VolumeGetReq) VolumeGetResp {
 	resp := VolumeGetResp{}
 
-	vol, err := d.findVolume(req.Name)
+	vol, sub, err := d.lookupVolume(req.Name)
 	if err != nil {
 		resp.Err = err.Error()
 		logger.Error(resp.Err)
@@ -631,6 +1433,31 @@ func (d *CinderDriver) Get(logger *logrus.Entry, req VolumeGetReq) VolumeGetResp
 		return resp
 	}
 
+	if sub != nil {
+		resp.Volume.Name = sub.Name
+		resp.Volume.Status = map[string]interface{}{
+			"Parent":   vol.Name,
+			"ParentID": vol.ID,
+			"UID":      sub.UID,
+			"GID":      sub.GID,
+			"Mode":     sub.Mode,
+		}
+
+		if sub.Quota != "" {
+			d.addQuotaStatus(logger, resp.Volume.Status, vol, sub.Project)
+		}
+
+		resp.Volume.Mountpoint, err = subVolumeMountpoint(*sub)
+		if err != nil {
+			resp.Err = fmt.Sprintf("checking if volume %s is already mounted: %v", req.Name, err)
+			logger.Error(resp.Err)
+
+			return resp
+		}
+
+		return resp
+	}
+
 	resp.Volume.Name = vol.Name
 	resp.Volume.Status = map[string]interface{}{
 		"ID":                 vol.ID,
@@ -638,26 +1465,64 @@ func (d *CinderDriver) Get(logger *logrus.Entry, req VolumeGetReq) VolumeGetResp
 		"ConsistencyGroupID": vol.ConsistencyGroupID,
 		"Description":        vol.Description,
 		"Size":               vol.Size,
+		"Status":             vol.Status,
 		"Type":               vol.VolumeType,
 		"CreatedAt":          vol.CreatedAt.String(),
 		"UpdatedAt":          vol.UpdatedAt.String(),
 		"Metadata":           vol.Metadata,
+		"Labels":             volumeLabels(vol),
 	}
 
-	mountpoint := path.Join(propagatedMount, vol.ID)
-	if ok, err := isMounted(mountpoint); err != nil {
+	st := d.state.get(vol.ID)
+	if st.Fsck != nil {
+		resp.Volume.Status["Fsck"] = st.Fsck
+	}
+	if !st.LastUnmount.IsZero() {
+		resp.Volume.Status["LastUnmount"] = st.LastUnmount.String()
+	}
+
+	if vol.Metadata[metadataFieldSnapshotSchedule] != "" {
+		resp.Volume.Status["Snapshots"] = snapshotStatus(vol)
+	}
+
+	if vol.Metadata[metadataFieldQuota] != "" {
+		d.addQuotaStatus(logger, resp.Volume.Status, vol, datadirProject)
+	}
+
+	if isShared(vol) {
+		resp.Volume.Status["Access"] = accessShared
+		if writer := vol.Metadata[metadataFieldWriter]; writer != "" && isAttachedTo(vol, writer) {
+			resp.Volume.Status["Writer"] = writer
+		}
+	}
+
+	if isEncrypted(vol) {
+		resp.Volume.Status["Encrypted"] = true
+		if open, err := isMapperOpen(vol); err == nil && open {
+			resp.Volume.Status["Device"] = mapperPath(vol)
+		}
+	}
+
+	if subs, err := subVolumes(vol); err == nil && len(subs) > 0 {
+		names := make([]string, 0, len(subs))
+		for _, sub := range subs {
+			names = append(names, sub.Name)
+		}
+		resp.Volume.Status["SubVolumes"] = names
+	}
+
+	resp.Volume.Mountpoint, err = d.userMountpoint(vol)
+	if err != nil {
 		resp.Err = fmt.Sprintf("checking if volume %s is already mounted: %v", req.Name, err)
 		logger.Error(resp.Err)
 
 		return resp
-	} else if ok {
-		resp.Volume.Mountpoint = path.Join(mountpoint, "data")
 	}
 
 	return resp
 }
 
-func (d *CinderDriver) List(logger *logrus.Entry) VolumeListResp {
+func (d *CinderDriver) List(ctx context.Context, logger *logrus.Entry) VolumeListResp {
 	resp := VolumeListResp{
 		Volumes: make([]ListVolume, 0),
 	}
@@ -676,23 +1541,59 @@ func (d *CinderDriver) List(logger *logrus.Entry) VolumeListResp {
 			Mountpoint: "",
 		}
 
-		mountpoint := path.Join(propagatedMount, vol.ID)
-		if ok, err := isMounted(mountpoint); err != nil {
+		v.Mountpoint, err = d.userMountpoint(vol)
+		if err != nil {
 			resp.Err = fmt.Sprintf("checking if volume %s is already mounted: %v", vol.Name, err)
 			logger.Error(resp.Err)
 
 			return resp
-		} else if ok {
-			v.Mountpoint = path.Join(mountpoint, "data")
 		}
 
 		resp.Volumes = append(resp.Volumes, v)
+
+		subs, err := subVolumes(vol)
+		if err != nil {
+			resp.Err = fmt.Sprintf("listing sub-volumes of %s: %v", vol.Name, err)
+			logger.Error(resp.Err)
+
+			return resp
+		}
+
+		for _, sub := range subs {
+			mountpoint, err := subVolumeMountpoint(sub)
+			if err != nil {
+				resp.Err = fmt.Sprintf("checking if volume %s is already mounted: %v", sub.Name, err)
+				logger.Error(resp.Err)
+
+				return resp
+			}
+
+			resp.Volumes = append(resp.Volumes, ListVolume{Name: sub.Name, Mountpoint: mountpoint})
+		}
 	}
 
 	return resp
 }
 
+// listVolumes returns the volumes managed by the plugin, except those retained
+// by Remove().
 func (d *CinderDriver) listVolumes() ([]volumes.Volume, error) {
+	all, err := d.listAllVolumes()
+	if err != nil {
+		return all, err
+	}
+
+	vols := make([]volumes.Volume, 0, len(all))
+	for _, v := range all {
+		if !isRemoved(v) {
+			vols = append(vols, v)
+		}
+	}
+
+	return vols, nil
+}
+
+func (d *CinderDriver) listAllVolumes() ([]volumes.Volume, error) {
 	vols := make([]volumes.Volume, 0)
 
 	allPages, err := volumes.List(d.storageClient, nil).AllPages()
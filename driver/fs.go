@@ -0,0 +1,730 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/opencontainers/selinux/go-selinux"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// defaultFS is the filesystem used for volumes created without the fs option,
+// including all the volumes created before that option existed.
+const defaultFS = "ext4"
+
+type filesystem struct {
+	// mkfs is the name of the binary used to format a device with this filesystem.
+	mkfs string
+	// mkfsForce is the flag telling mkfs to not ask for confirmation.
+	mkfsForce string
+	// mkfsFlags lists the flags users can pass through the mkfs_opts volume
+	// option. The value tells whether the flag expects an argument.
+	mkfsFlags map[string]bool
+	// mountOpts lists the filesystem-specific options users can pass through
+	// the mount_opts volume option (without their value, if any).
+	mountOpts []string
+	// readonlyMountOpts lists the mountOpts only allowed on read-only mounts,
+	// as they leave the filesystem inconsistent otherwise.
+	readonlyMountOpts []string
+	// noReplay is the mount option preventing the journal from being replayed,
+	// for filesystems mounted in read-only mode while being written elsewhere.
+	noReplay string
+	// cluster is true for filesystems which can be mounted in read-write mode
+	// on several servers at once. They're never formatted by the plugin, as
+	// that depends on the cluster they belong to.
+	cluster bool
+}
+
+var filesystems = map[string]filesystem{
+	"ext4": {
+		mkfs:      "mkfs.ext4",
+		mkfsForce: "-F",
+		mkfsFlags: map[string]bool{
+			"-b": true, "-C": true, "-e": true, "-E": true, "-g": true, "-G": true,
+			"-i": true, "-I": true, "-j": false, "-J": true, "-L": true, "-m": true,
+			"-N": true, "-O": true, "-q": false, "-T": true, "-U": true, "-v": false,
+		},
+		mountOpts: []string{
+			"acl", "noacl", "auto_da_alloc", "noauto_da_alloc", "barrier", "nobarrier",
+			"commit", "data", "delalloc", "nodelalloc", "dioread_lock", "dioread_nolock",
+			"discard", "nodiscard", "errors", "grpid", "nogrpid", "i_version",
+			"init_itable", "noinit_itable", "inode_readahead_blks", "journal_async_commit",
+			"journal_checksum", "nojournal_checksum", "max_batch_time", "min_batch_time",
+			"nombcache", "noload", "prjquota", "resgid", "resuid", "stripe",
+			"user_xattr", "nouser_xattr",
+		},
+		readonlyMountOpts: []string{"noload"},
+		noReplay:          "noload",
+	},
+	"xfs": {
+		mkfs:      "mkfs.xfs",
+		mkfsForce: "-f",
+		mkfsFlags: map[string]bool{
+			"-b": true, "-d": true, "-i": true, "-K": false, "-l": true, "-L": true,
+			"-m": true, "-n": true, "-q": false, "-r": true, "-s": true,
+		},
+		mountOpts: []string{
+			"allocsize", "attr2", "noattr2", "discard", "nodiscard", "filestreams",
+			"grpid", "nogrpid", "ikeep", "noikeep", "inode32", "inode64", "largeio",
+			"nolargeio", "logbsize", "logbufs", "noalign", "norecovery", "nouuid",
+			"pquota", "prjquota", "pqnoenforce", "sunit", "swalloc", "swidth", "wsync",
+		},
+		readonlyMountOpts: []string{"norecovery"},
+		noReplay:          "norecovery",
+	},
+	"btrfs": {
+		mkfs:      "mkfs.btrfs",
+		mkfsForce: "-f",
+		mkfsFlags: map[string]bool{
+			"-d": true, "--data": true, "-m": true, "--metadata": true,
+			"-n": true, "--nodesize": true, "-s": true, "--sectorsize": true,
+			"-L": true, "--label": true, "-O": true, "--features": true,
+			"-R": true, "--runtime-features": true, "-U": true, "--uuid": true,
+			"--csum": true, "-K": false, "--nodiscard": false, "-q": false,
+		},
+		mountOpts: []string{
+			"acl", "noacl", "autodefrag", "noautodefrag", "barrier", "nobarrier",
+			"commit", "compress", "compress-force", "datacow", "nodatacow", "datasum",
+			"nodatasum", "discard", "nodiscard", "flushoncommit", "noflushoncommit",
+			"max_inline", "metadata_ratio", "space_cache", "nospace_cache", "ssd",
+			"nossd", "ssd_spread", "nossd_spread", "subvol", "subvolid", "thread_pool",
+			"rescue",
+		},
+		readonlyMountOpts: []string{"rescue"},
+		noReplay:          "rescue=nologreplay",
+	},
+	"gfs2": {
+		mountOpts: []string{
+			"acl", "noacl", "barrier", "nobarrier", "commit", "data", "discard",
+			"nodiscard", "errors", "localflocks", "lockproto", "locktable", "quota",
+			"statfs_quantum", "statfs_percent",
+		},
+		cluster: true,
+	},
+	"ocfs2": {
+		mountOpts: []string{
+			"acl", "noacl", "atime_quantum", "barrier", "commit", "coherency",
+			"data", "errors", "localflocks", "resv_level", "dir_resv_level",
+			"user_xattr", "nouser_xattr",
+		},
+		cluster: true,
+	},
+}
+
+// mountFlags maps the generic mount options to their mount(2) flag. ro isn't
+// part of them, as read-only mounts are requested through the readonly option.
+var mountFlags = map[string]uintptr{
+	"nosuid":      unix.MS_NOSUID,
+	"nodev":       unix.MS_NODEV,
+	"noexec":      unix.MS_NOEXEC,
+	"sync":        unix.MS_SYNCHRONOUS,
+	"dirsync":     unix.MS_DIRSYNC,
+	"noatime":     unix.MS_NOATIME,
+	"nodiratime":  unix.MS_NODIRATIME,
+	"relatime":    unix.MS_RELATIME,
+	"strictatime": unix.MS_STRICTATIME,
+	"lazytime":    unix.MS_LAZYTIME,
+}
+
+func supportedFilesystems() []string {
+	names := make([]string, 0, len(filesystems))
+	for name := range filesystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func validateFS(fsType string) error {
+	if _, ok := filesystems[fsType]; !ok {
+		return fmt.Errorf("unsupported filesystem %s (supported: %s)", fsType, strings.Join(supportedFilesystems(), ", "))
+	}
+
+	return nil
+}
+
+// externalDeviceMkfsOpts lists the mkfs sub-options putting part of the
+// filesystem on another device (the ext4 journal, the xfs log and realtime
+// section). Such devices would be formatted too, while the plugin doesn't own
+// them.
+var externalDeviceMkfsOpts = []string{"device", "logdev", "rtdev"}
+
+// parseMkfsOpts splits the mkfs_opts volume option into arguments, and makes
+// sure only allowlisted flags are passed to mkfs.
+func parseMkfsOpts(fsType, opts string) ([]string, error) {
+	fs := filesystems[fsType]
+	args := strings.Fields(opts)
+
+	for i := 0; i < len(args); i++ {
+		flag, value, hasValue := strings.Cut(args[i], "=")
+
+		takesArg, ok := fs.mkfsFlags[flag]
+		if !ok {
+			return nil, fmt.Errorf("mkfs option %s is not allowed for %s", args[i], fsType)
+		}
+		if !takesArg {
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("mkfs option %s expects an argument", flag)
+			}
+			i++
+			value = args[i]
+		}
+
+		for _, subOpt := range strings.Split(value, ",") {
+			if name, _, _ := strings.Cut(subOpt, "="); slices.Contains(externalDeviceMkfsOpts, name) {
+				return nil, fmt.Errorf("mkfs option %s %s is not allowed, filesystems can't span other devices", flag, value)
+			}
+		}
+	}
+
+	return args, nil
+}
+
+// parseMountOpts converts the comma-separated mount_opts volume option into
+// mount(2) flags and a data string. Unless one of the atime options is
+// specified, relatime is used. readonly tells whether the filesystem is to be
+// mounted in read-only mode.
+func parseMountOpts(fsType, opts string, readonly bool) (uintptr, string, error) {
+	fs := filesystems[fsType]
+
+	var flags uintptr
+	data := make([]string, 0)
+
+	for _, opt := range strings.Split(opts, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+
+		if flag, ok := mountFlags[opt]; ok {
+			flags |= flag
+			continue
+		} else if opt == "ro" {
+			return 0, "", fmt.Errorf("mount option ro is not allowed, use the readonly option instead")
+		}
+
+		name, _, _ := strings.Cut(opt, "=")
+		if !slices.Contains(fs.mountOpts, name) {
+			return 0, "", fmt.Errorf("mount option %s is not allowed for %s", opt, fsType)
+		}
+		if slices.Contains(fs.readonlyMountOpts, name) && !readonly {
+			return 0, "", fmt.Errorf("mount option %s is only allowed for read-only volumes", opt)
+		}
+
+		data = append(data, opt)
+	}
+
+	if flags&(unix.MS_NOATIME|unix.MS_RELATIME|unix.MS_STRICTATIME) == 0 {
+		flags |= unix.MS_RELATIME
+	}
+
+	return flags, strings.Join(data, ","), nil
+}
+
+func getFSMetadata(vol volumes.Volume) (string, error) {
+	fsType := defaultFS
+	if v, ok := vol.Metadata[metadataFieldFS]; ok && v != "" {
+		fsType = v
+	}
+
+	if err := validateFS(fsType); err != nil {
+		return "", fmt.Errorf("reading %s: %v", metadataFieldFS, err)
+	}
+
+	return fsType, nil
+}
+
+// mount mounts dev on mountpoint. With noReplay, the journal of read-only
+// filesystems is left as is, e.g. because the filesystem is being written by
+// another server.
+func (d *CinderDriver) mount(dev, mountpoint, fsType, mountOpts string, readonly, noReplay bool) error {
+	flags, data, err := parseMountOpts(fsType, mountOpts, readonly)
+	if err != nil {
+		return err
+	}
+
+	if readonly {
+		flags |= unix.MS_RDONLY
+
+		extra := make([]string, 0, 2)
+		// Journals can't be replayed when the device itself is read-only.
+		if ro, err := isDeviceReadonly(dev); err != nil {
+			return err
+		} else if (ro || noReplay) && filesystems[fsType].noReplay != "" {
+			extra = append(extra, filesystems[fsType].noReplay)
+		}
+		if selinux.GetEnabled() {
+			extra = append(extra, fmt.Sprintf("context=%q", containerFileLabel))
+		}
+
+		if data != "" {
+			extra = append([]string{data}, extra...)
+		}
+		data = strings.Join(extra, ",")
+	}
+
+	if err := os.MkdirAll(mountpoint, 0750); err != nil {
+		return fmt.Errorf("failed to create mountpoint directory %s: %v", mountpoint, err)
+	}
+
+	if err := unix.Mount(dev, mountpoint, fsType, flags, data); err != nil {
+		return fmt.Errorf("mount syscall failed: %v", err)
+	}
+
+	return nil
+}
+
+func (d *CinderDriver) format(dev, fsType, mkfsOpts string) error {
+	fs := filesystems[fsType]
+
+	args, err := parseMkfsOpts(fsType, mkfsOpts)
+	if err != nil {
+		return err
+	}
+
+	args = append([]string{fs.mkfsForce}, args...)
+	args = append(args, dev)
+
+	if err := exec.Command(fs.mkfs, args...).Run(); err != nil {
+		return fmt.Errorf("%s on %s failed: %v", fs.mkfs, dev, err)
+	}
+
+	return nil
+}
+
+type blockDevice struct {
+	Name     string        `json:"name"`
+	FSType   string        `json:"fstype,omitempty"`
+	PTType   string        `json:"pttype,omitempty"`
+	Children []blockDevice `json:"children,omitempty"`
+}
+
+// probeDevice returns what lsblk knows about dev and its children.
+func probeDevice(dev string) (blockDevice, error) {
+	output, err := exec.Command("lsblk", "--json", "--output", "NAME,FSTYPE,PTTYPE", dev).Output()
+	if err != nil {
+		return blockDevice{}, fmt.Errorf("listing block devices failed: %v", err)
+	}
+
+	var result struct {
+		Blockdevices []blockDevice `json:"blockdevices"`
+	}
+
+	if err := json.Unmarshal(output, &result); err != nil {
+		return blockDevice{}, fmt.Errorf("parsing block devices failed: %v", err)
+	}
+
+	if len(result.Blockdevices) < 1 {
+		return blockDevice{}, fmt.Errorf("device %s not found", dev)
+	}
+
+	return result.Blockdevices[0], nil
+}
+
+// isFormatted reports whether dev holds a filesystem of type fsType. It returns
+// false when the device is blank, and an error when it holds anything else.
+func isFormatted(dev, fsType string) (bool, error) {
+	d, err := probeDevice(dev)
+	if err != nil {
+		return false, err
+	}
+
+	if d.FSType == fsType {
+		return true, nil
+	}
+
+	if d.Children != nil {
+		return false, fmt.Errorf("device %s has a partition table", dev)
+	} else if d.FSType != "" {
+		return false, fmt.Errorf("device %s has a %s filesystem (expected %s)", dev, d.FSType, fsType)
+	}
+
+	return false, nil
+}
+
+// growThreshold is the minimum difference between the size of a device and the
+// size of its filesystem for the filesystem to be considered as not spanning
+// the whole device. Cinder volumes are sized in GB, so anything below is just
+// filesystem overhead and rounding.
+const growThreshold = 512 << 20
+
+// growIfNeeded grows the filesystem mounted on mountpoint when it doesn't span
+// the whole device, e.g. because the volume was extended.
+func growIfNeeded(logger *logrus.Entry, dev, mountpoint, fsType string, volSize int) error {
+	// Cluster filesystems have to be grown with their own tools, from a single
+	// server.
+	if filesystems[fsType].cluster {
+		return nil
+	}
+
+	if err := refreshDeviceSize(dev, volSize); err != nil {
+		return err
+	}
+
+	devSize, err := deviceSize(dev)
+	if err != nil {
+		return err
+	}
+
+	fsSize, err := filesystemSize(dev, mountpoint, fsType)
+	if err != nil {
+		return err
+	}
+
+	if devSize-fsSize < growThreshold {
+		return nil
+	}
+
+	logger.Infof("Filesystem (%d bytes) is smaller than its device (%d bytes). Growing...", fsSize, devSize)
+
+	return growFS(dev, mountpoint, fsType)
+}
+
+// refreshDeviceSize makes sure the kernel noticed the volume backing dev was
+// extended to volSize GB. SCSI devices don't notice it by themselves.
+func refreshDeviceSize(dev string, volSize int) error {
+	devSize, err := deviceSize(dev)
+	if err != nil {
+		return err
+	}
+
+	if devSize < int64(volSize)<<30 {
+		return rescanDevice(dev)
+	}
+
+	return nil
+}
+
+// isDeviceReadonly reports whether the kernel prevents writes to dev.
+func isDeviceReadonly(dev string) (bool, error) {
+	sysname, err := sysBlockName(dev)
+	if err != nil {
+		return false, err
+	}
+
+	ro, err := readSysBlockInt(path.Join("/sys/class/block", sysname, "ro"))
+	if err != nil {
+		return false, err
+	}
+
+	return ro == 1, nil
+}
+
+// deviceSize returns the size of dev, in bytes, as currently seen by the kernel.
+func deviceSize(dev string) (int64, error) {
+	sysname, err := sysBlockName(dev)
+	if err != nil {
+		return 0, err
+	}
+
+	content, err := os.ReadFile(path.Join("/sys/class/block", sysname, "size"))
+	if err != nil {
+		return 0, fmt.Errorf("reading size of %s: %v", dev, err)
+	}
+
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing size of %s: %v", dev, err)
+	}
+
+	// The size file is always expressed in 512-byte sectors.
+	return sectors * 512, nil
+}
+
+// rescanDevice asks the SCSI layer to reread the capacity of dev. Other
+// devices (e.g. virtio-blk) are notified by the hypervisor, so it's a no-op.
+func rescanDevice(dev string) error {
+	sysname, err := sysBlockName(dev)
+	if err != nil {
+		return err
+	}
+
+	rescan := path.Join("/sys/class/block", sysname, "device", "rescan")
+	if _, err := os.Stat(rescan); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := os.WriteFile(rescan, []byte("1"), 0200); err != nil {
+		return fmt.Errorf("rescanning %s: %v", dev, err)
+	}
+
+	return nil
+}
+
+// sysBlockName returns the name of dev under /sys/class/block. Symlinks
+// (e.g. /dev/mapper entries) are resolved first.
+func sysBlockName(dev string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %v", dev, err)
+	}
+
+	return path.Base(resolved), nil
+}
+
+var (
+	xfsDataRegexp    = regexp.MustCompile(`data\s+=\s+bsize=(\d+)\s+blocks=(\d+)`)
+	btrfsDevidRegexp = regexp.MustCompile(`devid\s+\d+\s+size\s+(\d+)`)
+)
+
+// filesystemSize returns the size, in bytes, of the filesystem stored on dev
+// and mounted on mountpoint.
+func filesystemSize(dev, mountpoint, fsType string) (int64, error) {
+	var blockSize, blockCount string
+
+	switch fsType {
+	case "ext4":
+		output, err := exec.Command("dumpe2fs", "-h", dev).Output()
+		if err != nil {
+			return 0, fmt.Errorf("dumpe2fs on %s failed: %v", dev, err)
+		}
+
+		for _, line := range strings.Split(string(output), "\n") {
+			key, value, _ := strings.Cut(line, ":")
+			switch key {
+			case "Block count":
+				blockCount = strings.TrimSpace(value)
+			case "Block size":
+				blockSize = strings.TrimSpace(value)
+			}
+		}
+	case "xfs":
+		output, err := exec.Command("xfs_info", mountpoint).Output()
+		if err != nil {
+			return 0, fmt.Errorf("xfs_info on %s failed: %v", mountpoint, err)
+		}
+
+		if m := xfsDataRegexp.FindStringSubmatch(string(output)); m != nil {
+			blockSize, blockCount = m[1], m[2]
+		}
+	case "btrfs":
+		output, err := exec.Command("btrfs", "filesystem", "show", "--raw", mountpoint).Output()
+		if err != nil {
+			return 0, fmt.Errorf("btrfs filesystem show on %s failed: %v", mountpoint, err)
+		}
+
+		if m := btrfsDevidRegexp.FindStringSubmatch(string(output)); m != nil {
+			blockSize, blockCount = "1", m[1]
+		}
+	}
+
+	if blockSize == "" || blockCount == "" {
+		return 0, fmt.Errorf("could not find the size of the %s filesystem on %s", fsType, dev)
+	}
+
+	bs, err := strconv.ParseInt(blockSize, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing block size of %s: %v", dev, err)
+	}
+	bc, err := strconv.ParseInt(blockCount, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing block count of %s: %v", dev, err)
+	}
+
+	return bs * bc, nil
+}
+
+// growFS grows the filesystem mounted on mountpoint to the size of its device.
+func growFS(dev, mountpoint, fsType string) error {
+	var cmd *exec.Cmd
+
+	switch fsType {
+	case "ext4":
+		cmd = exec.Command("resize2fs", dev)
+	case "xfs":
+		cmd = exec.Command("xfs_growfs", mountpoint)
+	case "btrfs":
+		cmd = exec.Command("btrfs", "filesystem", "resize", "max", mountpoint)
+	}
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("growing %s filesystem on %s failed: %v: %s", fsType, dev, err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+const (
+	fsckNever  = "never"
+	fsckCheck  = "check"
+	fsckRepair = "repair"
+)
+
+func validateFsckPolicy(policy string) error {
+	switch policy {
+	case fsckNever, fsckCheck, fsckRepair:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported fsck policy %s (supported: %s, %s, %s)", policy, fsckNever, fsckCheck, fsckRepair)
+}
+
+const (
+	fsckClean    = "clean"
+	fsckRepaired = "repaired"
+	fsckDirtyLog = "dirty-log"
+	fsckErrors   = "errors"
+	// fsckSkipped is recorded for filesystems the plugin has no checker for.
+	fsckSkipped = "skipped"
+)
+
+// fsckResult is the outcome of the last filesystem check run before mounting
+// a volume.
+type fsckResult struct {
+	Policy string
+	Result string
+	Output string `json:",omitempty"`
+	Time   time.Time
+}
+
+// checkFS runs fsck on dev according to the fsck policy of vol, and records
+// the result in the local state.
+func (d *CinderDriver) checkFS(logger *logrus.Entry, vol volumes.Volume, dev, fsType string) error {
+	policy := d.fsckPolicy
+	if v, ok := vol.Metadata[metadataFieldFsck]; ok && v != "" {
+		policy = v
+	}
+
+	if err := validateFsckPolicy(policy); err != nil {
+		return fmt.Errorf("reading %s: %v", metadataFieldFsck, err)
+	}
+	if readonly, err := d.isReadonly(vol); err != nil {
+		return err
+	} else if readonly && policy == fsckRepair {
+		policy = fsckCheck
+	}
+	if policy == fsckNever {
+		return nil
+	}
+	// The filesystem might be mounted by another server.
+	if isShared(vol) {
+		logger.Debugf("Not checking the filesystem of shared volume %s.", vol.Name)
+		return nil
+	}
+
+	logger.Debugf("Checking the filesystem (policy: %s)...", policy)
+
+	res, err := runFsck(dev, fsType, policy)
+	if res.Result != "" {
+		if err := d.state.update(vol.ID, func(st *volumeState) { st.Fsck = &res }); err != nil {
+			logger.Warnf("Could not save the fsck result: %v", err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if res.Result != fsckClean {
+		logger.Warnf("Filesystem check result: %s.", res.Result)
+	}
+
+	return nil
+}
+
+// runFsck runs fsck on dev according to policy. An error is returned when the
+// filesystem can't be safely mounted, or when fsck couldn't run at all.
+func runFsck(dev, fsType, policy string) (fsckResult, error) {
+	res := fsckResult{Policy: policy, Time: time.Now()}
+
+	var cmd *exec.Cmd
+	switch fsType {
+	case "ext4":
+		if policy == fsckRepair {
+			cmd = exec.Command("e2fsck", "-p", dev)
+			break
+		}
+
+		// e2fsck -n doesn't replay the journal, and reports errors on
+		// filesystems needing recovery, e.g. after their server crashed. The
+		// journal is replayed by the kernel when mounting.
+		if recovery, err := ext4NeedsRecovery(dev); err != nil {
+			return res, err
+		} else if recovery {
+			res.Result = fsckDirtyLog
+			return res, nil
+		}
+		cmd = exec.Command("e2fsck", "-n", dev)
+	case "xfs":
+		if policy == fsckRepair {
+			cmd = exec.Command("xfs_repair", dev)
+		} else {
+			cmd = exec.Command("xfs_repair", "-n", dev)
+		}
+	case "btrfs":
+		// btrfs check --repair is known to make things worse in some cases, so
+		// btrfs filesystems are only ever checked.
+		cmd = exec.Command("btrfs", "check", "--readonly", dev)
+	default:
+		res.Result = fsckSkipped
+		res.Output = fmt.Sprintf("no fsck for %s", fsType)
+		return res, nil
+	}
+
+	output, err := cmd.CombinedOutput()
+	res.Output = strings.TrimSpace(string(output))
+
+	exitCode := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitCode = exitErr.ExitCode()
+	} else if err != nil {
+		return res, fmt.Errorf("running %s on %s failed: %v", cmd.Path, dev, err)
+	}
+
+	res.Result = fsckExitResult(fsType, exitCode)
+	if res.Result == fsckErrors {
+		return res, fmt.Errorf("filesystem on %s has errors that were not repaired (fsck policy: %s, exit code: %d)", dev, policy, exitCode)
+	}
+
+	return res, nil
+}
+
+// fsckExitResult maps the exit code of the fsck of fsType to its result.
+func fsckExitResult(fsType string, exitCode int) string {
+	switch {
+	case exitCode == 0:
+		return fsckClean
+	// e2fsck: 1 means errors were corrected, 2 that the system should be
+	// rebooted, which doesn't apply to a data volume.
+	case fsType == "ext4" && (exitCode == 1 || exitCode == 2):
+		return fsckRepaired
+	// xfs_repair refuses to run when the log is dirty. The log is replayed by
+	// the kernel when mounting.
+	case fsType == "xfs" && exitCode == 2:
+		return fsckDirtyLog
+	}
+
+	return fsckErrors
+}
+
+// ext4NeedsRecovery returns whether the journal of the ext4 filesystem on dev
+// has to be replayed.
+func ext4NeedsRecovery(dev string) (bool, error) {
+	output, err := exec.Command("dumpe2fs", "-h", dev).Output()
+	if err != nil {
+		return false, fmt.Errorf("reading the superblock of %s failed: %v", dev, err)
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		if features, ok := strings.CutPrefix(line, "Filesystem features:"); ok {
+			return slices.Contains(strings.Fields(features), "needs_recovery"), nil
+		}
+	}
+
+	return false, nil
+}
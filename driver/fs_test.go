@@ -0,0 +1,131 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFsckExitResult(t *testing.T) {
+	tcs := []struct {
+		fsType   string
+		exitCode int
+		expected string
+	}{
+		{fsType: "ext4", exitCode: 0, expected: fsckClean},
+		{fsType: "ext4", exitCode: 1, expected: fsckRepaired},
+		{fsType: "ext4", exitCode: 2, expected: fsckRepaired},
+		// e2fsck -n reports uncorrected errors with 4.
+		{fsType: "ext4", exitCode: 4, expected: fsckErrors},
+		{fsType: "ext4", exitCode: 8, expected: fsckErrors},
+		{fsType: "xfs", exitCode: 0, expected: fsckClean},
+		{fsType: "xfs", exitCode: 1, expected: fsckErrors},
+		{fsType: "xfs", exitCode: 2, expected: fsckDirtyLog},
+		{fsType: "btrfs", exitCode: 0, expected: fsckClean},
+		{fsType: "btrfs", exitCode: 1, expected: fsckErrors},
+		{fsType: "btrfs", exitCode: 2, expected: fsckErrors},
+	}
+
+	for _, tc := range tcs {
+		if got := fsckExitResult(tc.fsType, tc.exitCode); got != tc.expected {
+			t.Errorf("fsckExitResult(%s, %d): expected %s, got %s", tc.fsType, tc.exitCode, tc.expected, got)
+		}
+	}
+}
+
+func TestParseMkfsOpts(t *testing.T) {
+	tcs := []struct {
+		fsType   string
+		opts     string
+		expected []string
+		err      bool
+	}{
+		{fsType: "ext4", opts: "", expected: []string{}},
+		{fsType: "ext4", opts: "-E lazy_itable_init=0 -m 1", expected: []string{"-E", "lazy_itable_init=0", "-m", "1"}},
+		{fsType: "ext4", opts: "-J size=64", expected: []string{"-J", "size=64"}},
+		{fsType: "ext4", opts: "-q -L data", expected: []string{"-q", "-L", "data"}},
+		{fsType: "xfs", opts: "-l size=64m,lazy-count=1", expected: []string{"-l", "size=64m,lazy-count=1"}},
+		{fsType: "btrfs", opts: "--label=data -K", expected: []string{"--label=data", "-K"}},
+		{fsType: "ext4", opts: "-J device=/dev/vdc", err: true},
+		{fsType: "ext4", opts: "-J size=64,device=/dev/vdc", err: true},
+		{fsType: "ext4", opts: "-J=device=UUID=1234", err: true},
+		{fsType: "xfs", opts: "-l logdev=/dev/sda", err: true},
+		{fsType: "xfs", opts: "-l size=64m,logdev=/dev/sda", err: true},
+		{fsType: "xfs", opts: "-r rtdev=/dev/sda", err: true},
+		{fsType: "ext4", opts: "-d /etc", err: true},
+		{fsType: "ext4", opts: "-L", err: true},
+		{fsType: "xfs", opts: "-J size=64", err: true},
+		{fsType: "gfs2", opts: "-L data", err: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.fsType+" "+tc.opts, func(t *testing.T) {
+			args, err := parseMkfsOpts(tc.fsType, tc.opts)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(args, tc.expected) {
+				t.Fatalf("expected %q, got %q", tc.expected, args)
+			}
+		})
+	}
+}
+
+func TestParseMountOpts(t *testing.T) {
+	tcs := []struct {
+		fsType   string
+		opts     string
+		readonly bool
+		flags    uintptr
+		data     string
+		err      bool
+	}{
+		{fsType: "ext4", opts: "", flags: unix.MS_RELATIME},
+		{fsType: "ext4", opts: "noatime, nodev,nosuid", flags: unix.MS_NOATIME | unix.MS_NODEV | unix.MS_NOSUID},
+		{fsType: "ext4", opts: "discard,commit=30,nodev", flags: unix.MS_RELATIME | unix.MS_NODEV, data: "discard,commit=30"},
+		{fsType: "xfs", opts: "strictatime,logbufs=8", flags: unix.MS_STRICTATIME, data: "logbufs=8"},
+		{fsType: "btrfs", opts: "compress=zstd,ssd", flags: unix.MS_RELATIME, data: "compress=zstd,ssd"},
+		{fsType: "xfs", opts: "norecovery", readonly: true, flags: unix.MS_RELATIME, data: "norecovery"},
+		{fsType: "btrfs", opts: "rescue=nologreplay", readonly: true, flags: unix.MS_RELATIME, data: "rescue=nologreplay"},
+		{fsType: "ext4", opts: "noload", readonly: true, flags: unix.MS_RELATIME, data: "noload"},
+		{fsType: "ext4", opts: "ro", err: true},
+		{fsType: "ext4", opts: "noatime,ro", readonly: true, err: true},
+		{fsType: "xfs", opts: "norecovery", err: true},
+		{fsType: "btrfs", opts: "rescue=nologreplay", err: true},
+		{fsType: "btrfs", opts: "rescue=all", err: true},
+		{fsType: "ext4", opts: "noload", err: true},
+		{fsType: "ext4", opts: "compress=zstd", err: true},
+		{fsType: "xfs", opts: "journal_dev=/dev/sda", err: true},
+		{fsType: "ext4", opts: "suid", err: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.fsType+" "+tc.opts, func(t *testing.T) {
+			flags, data, err := parseMountOpts(tc.fsType, tc.opts, tc.readonly)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %#x %q", flags, data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if flags != tc.flags {
+				t.Errorf("expected flags %#x, got %#x", tc.flags, flags)
+			}
+			if data != tc.data {
+				t.Errorf("expected data %q, got %q", tc.data, data)
+			}
+		})
+	}
+}
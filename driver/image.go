@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+)
+
+// findImage resolves the source_image option, either the ID or the name of a
+// Glance image.
+func (d *CinderDriver) findImage(ref string) (images.Image, error) {
+	if d.imageClient == nil {
+		return images.Image{}, errors.New("the image service isn't available")
+	}
+
+	img, err := images.Get(d.imageClient, ref).Extract()
+	if err == nil {
+		return *img, nil
+	} else if _, ok := err.(gophercloud.ErrDefault404); !ok {
+		return images.Image{}, fmt.Errorf("could not get image %s: %v", ref, err)
+	}
+
+	allPages, err := images.List(d.imageClient, images.ListOpts{Name: ref}).AllPages()
+	if err != nil {
+		return images.Image{}, fmt.Errorf("listing images named %s: %v", ref, err)
+	}
+
+	list, err := images.ExtractImages(allPages)
+	if err != nil {
+		return images.Image{}, fmt.Errorf("extracting images from api response: %v", err)
+	}
+
+	switch len(list) {
+	case 0:
+		return images.Image{}, fmt.Errorf("image %s not found", ref)
+	case 1:
+		return list[0], nil
+	}
+
+	return images.Image{}, fmt.Errorf("%d images are named %s, use the image ID instead", len(list), ref)
+}
+
+// imageMinSize returns the minimal size, in GB, of a volume created from img.
+func imageMinSize(img images.Image) int {
+	size := img.VirtualSize
+	if size == 0 {
+		size = img.SizeBytes
+	}
+
+	minSize := int((size + 1<<30 - 1) >> 30)
+	if img.MinDiskGigabytes > minSize {
+		minSize = img.MinDiskGigabytes
+	}
+
+	return minSize
+}
+
+// checkVolumeReady makes sure vol can be attached. Volumes created from an
+// image stay in creating or downloading status while the image is copied,
+// which might take a while. The same goes for backups being restored.
+func checkVolumeReady(vol volumes.Volume) error {
+	switch vol.Status {
+	case "creating", "downloading":
+		return fmt.Errorf("volume %s is still being created (status: %s), try again later", vol.Name, vol.Status)
+	case "restoring-backup":
+		return fmt.Errorf("a backup is being restored into volume %s, try again later", vol.Name)
+	case "awaiting-transfer":
+		return fmt.Errorf("volume %s is being transferred to another project", vol.Name)
+	case "error":
+		return fmt.Errorf("volume %s is in error status", vol.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+)
+
+func TestImageMinSize(t *testing.T) {
+	const gb = 1 << 30
+
+	tcs := []struct {
+		name     string
+		img      images.Image
+		expected int
+	}{
+		{name: "virtual size", img: images.Image{VirtualSize: 10 * gb, SizeBytes: gb}, expected: 10},
+		{name: "virtual size rounded up", img: images.Image{VirtualSize: 2*gb + 1}, expected: 3},
+		{name: "file size without virtual size", img: images.Image{SizeBytes: gb / 2}, expected: 1},
+		{name: "min disk above size", img: images.Image{VirtualSize: 2 * gb, MinDiskGigabytes: 20}, expected: 20},
+		{name: "min disk below size", img: images.Image{VirtualSize: 8 * gb, MinDiskGigabytes: 4}, expected: 8},
+		{name: "no size", img: images.Image{}, expected: 0},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := imageMinSize(tc.img); got != tc.expected {
+				t.Fatalf("expected %d GB, got %d GB", tc.expected, got)
+			}
+		})
+	}
+}
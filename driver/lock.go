@@ -0,0 +1,28 @@
+package main
+
+import "sync"
+
+// volumeLocks serializes operations touching the same volume, e.g. mounting a
+// sub-volume while its parent is being unmounted.
+type volumeLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{locks: map[string]*sync.Mutex{}}
+}
+
+// lock locks the volume with the given ID and returns the function unlocking it.
+func (l *volumeLocks) lock(volID string) func() {
+	l.mu.Lock()
+	m, ok := l.locks[volID]
+	if !ok {
+		m = &sync.Mutex{}
+		l.locks[volID] = m
+	}
+	l.mu.Unlock()
+
+	m.Lock()
+	return m.Unlock
+}
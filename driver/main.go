@@ -7,6 +7,7 @@ import (
 	"os"
 	"runtime/pprof"
 	"strconv"
+	"time"
 
 	"github.com/docker/docker/volume"
 	"github.com/docker/go-plugins-helpers/sdk"
@@ -26,10 +27,30 @@ type VolumeCreateOpts struct {
 	Description        string `json:"description"`
 	SnapshotID         string `json:"source_snapshot"`
 	BackupID           string `json:"source_backup"`
+	SourceVolume       string `json:"source_volume"`
+	SourceImage        string `json:"source_image"`
 	VolumeType         string `json:"volume_type"`
 	Uid                string `json:"uid"`
 	Gid                string `json:"gid"`
 	Mode               string `json:"mode"`
+	FS                 string `json:"fs"`
+	MkfsOpts           string `json:"mkfs_opts"`
+	MountOpts          string `json:"mount_opts"`
+	Fsck               string `json:"fsck"`
+	Encrypted          string `json:"encrypted"`
+	EncryptionKey      string `json:"encryption_key"`
+	Partition          string `json:"partition"`
+	Readonly           string `json:"readonly"`
+	Parent             string `json:"parent"`
+	Quota              string `json:"quota"`
+	SnapshotSchedule   string `json:"snapshot_schedule"`
+	SnapshotKeep       string `json:"snapshot_keep"`
+	RemovePolicy       string `json:"remove_policy"`
+	Multiattach        string `json:"multiattach"`
+	Access             string `json:"access"`
+	// Labels are read from the meta.<key> options, and copied into the
+	// metadata of the Block Storage volume.
+	Labels map[string]string `json:"-"`
 }
 
 type VolumeCreateResp struct {
@@ -95,7 +116,210 @@ type ListVolume struct {
 	Mountpoint string
 }
 
+type VolumeResizeReq struct {
+	Name string
+	Size int
+}
+
+type VolumeResizeResp struct {
+	Err string
+}
+
+type Snapshot struct {
+	ID          string
+	Name        string
+	Volume      string
+	VolumeID    string
+	Status      string
+	Size        int
+	Description string
+	CreatedAt   string
+	Metadata    map[string]string
+}
+
+type SnapshotCreateReq struct {
+	Volume      string
+	Name        string
+	Description string
+}
+
+type SnapshotCreateResp struct {
+	Snapshot Snapshot
+	Err      string
+}
+
+type SnapshotListReq struct {
+	Volume string
+}
+
+type SnapshotListResp struct {
+	Snapshots []Snapshot
+	Err       string
+}
+
+type SnapshotGetReq struct {
+	Name string
+}
+
+type SnapshotGetResp struct {
+	Snapshot Snapshot
+	Err      string
+}
+
+type SnapshotRemoveReq struct {
+	Name string
+}
+
+type SnapshotRemoveResp struct {
+	Err string
+}
+
+type Backup struct {
+	ID          string
+	Name        string
+	Volume      string
+	VolumeID    string
+	Status      string
+	Size        int
+	Incremental bool
+	FailReason  string
+	Description string
+	CreatedAt   string
+	Metadata    map[string]string
+}
+
+type BackupCreateReq struct {
+	Volume      string
+	Name        string
+	Description string
+	Incremental bool
+}
+
+type BackupCreateResp struct {
+	Backup Backup
+	Err    string
+}
+
+type BackupListReq struct {
+	Volume string
+}
+
+type BackupListResp struct {
+	Backups []Backup
+	Err     string
+}
+
+type BackupGetReq struct {
+	Name string
+}
+
+type BackupGetResp struct {
+	Backup Backup
+	Err    string
+}
+
+type BackupRemoveReq struct {
+	Name string
+}
+
+type BackupRemoveResp struct {
+	Err string
+}
+
+type BackupRestoreReq struct {
+	Name   string
+	Volume string
+}
+
+type BackupRestoreResp struct {
+	Err string
+}
+
+// RetainedVolume is a volume retained by Remove() because of its remove policy.
+type RetainedVolume struct {
+	ID        string
+	Name      string
+	Size      int
+	RemovedAt string
+}
+
+type RetainedListReq struct{}
+
+type RetainedListResp struct {
+	Volumes []RetainedVolume
+	Err     string
+}
+
+type RetainedRestoreReq struct {
+	Name string
+	// NewName is the name the volume is restored under. It defaults to the
+	// name the volume had when it was removed.
+	NewName string
+}
+
+type RetainedRestoreResp struct {
+	Err string
+}
+
+// Transfer is a pending transfer of a volume to another OpenStack project.
+type Transfer struct {
+	ID       string
+	Volume   string
+	VolumeID string
+	// AuthKey is only returned when the transfer is created. It's needed
+	// along with the ID to accept the transfer.
+	AuthKey   string `json:",omitempty"`
+	CreatedAt string
+}
+
+type TransferCreateReq struct {
+	Volume string
+}
+
+type TransferCreateResp struct {
+	Transfer Transfer
+	Err      string
+}
+
+type TransferListReq struct{}
+
+type TransferListResp struct {
+	Transfers []Transfer
+	Err       string
+}
+
+type TransferAcceptReq struct {
+	ID      string
+	AuthKey string
+	// Name is the name of the volume in this project. It defaults to its name
+	// in the project it comes from, with the prefix of this one.
+	Name string
+}
+
+type TransferAcceptResp struct {
+	Name string
+	// Warning tells about what has to be done before using the volume.
+	Warning string `json:",omitempty"`
+	Err     string
+}
+
+type TransferRemoveReq struct {
+	ID string
+}
+
+type TransferRemoveResp struct {
+	Err string
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if logLevelCfg, ok := os.LookupEnv("LOG_LEVEL"); ok {
 		logLevel, err := logrus.ParseLevel(logLevelCfg)
 		if err != nil {
@@ -114,23 +338,105 @@ func main() {
 		var err error
 		defaultSize, err = strconv.Atoi(ds)
 		if err != nil {
-			logrus.Fatal("Provided DEFAULT_SIZE is invalid: %v.", err)
+			logrus.Fatalf("Provided DEFAULT_SIZE is invalid: %v.", err)
 		}
 	}
 
 	volumePrefix := os.Getenv("VOLUME_PREFIX")
 
+	fsckPolicy := fsckNever
+	if fp, ok := os.LookupEnv("FSCK_POLICY"); ok {
+		if err := validateFsckPolicy(fp); err != nil {
+			logrus.Fatalf("Provided FSCK_POLICY is invalid: %v.", err)
+		}
+		fsckPolicy = fp
+	}
+
+	removePolicy := removeDelete
+	if rp, ok := os.LookupEnv("REMOVE_POLICY"); ok {
+		if err := validateRemovePolicy(rp); err != nil {
+			logrus.Fatalf("Provided REMOVE_POLICY is invalid: %v.", err)
+		}
+		removePolicy = rp
+	}
+
+	stealPolicy := stealIfServerDown
+	if sp, ok := os.LookupEnv("STEAL_POLICY"); ok {
+		if err := validateStealPolicy(sp); err != nil {
+			logrus.Fatalf("Provided STEAL_POLICY is invalid: %v.", err)
+		}
+		stealPolicy = sp
+	}
+
+	keyDir := os.Getenv("KEY_DIR")
+	keyProviderCommand := os.Getenv("KEY_PROVIDER_COMMAND")
+
+	readonly := false
+	if ro, ok := os.LookupEnv("DEFAULT_READONLY"); ok {
+		var err error
+		readonly, err = strconv.ParseBool(ro)
+		if err != nil {
+			logrus.Fatalf("Provided DEFAULT_READONLY is invalid: %v.", err)
+		}
+	}
+
+	deviceWaitTimeout := lookupTimeout("DEVICE_WAIT_TIMEOUT", defaultDeviceWaitTimeout)
+	timeouts := Timeouts{
+		Create:   lookupTimeout("CREATE_TIMEOUT", defaultOperationTimeout),
+		Delete:   lookupTimeout("DELETE_TIMEOUT", defaultOperationTimeout),
+		Attach:   lookupTimeout("ATTACH_TIMEOUT", defaultOperationTimeout),
+		Detach:   lookupTimeout("DETACH_TIMEOUT", defaultOperationTimeout),
+		Extend:   lookupTimeout("EXTEND_TIMEOUT", defaultOperationTimeout),
+		Snapshot: lookupTimeout("SNAPSHOT_TIMEOUT", defaultOperationTimeout),
+	}
+
+	var idleDetachTimeout time.Duration
+	if idt, ok := os.LookupEnv("IDLE_DETACH_TIMEOUT"); ok {
+		secs, err := strconv.Atoi(idt)
+		if err != nil || secs < 0 {
+			logrus.Fatalf("Provided IDLE_DETACH_TIMEOUT is invalid: expected a number of seconds.")
+		}
+		idleDetachTimeout = time.Duration(secs) * time.Second
+	}
+
+	stateDir := defaultStateDir
+	if sd, ok := os.LookupEnv("STATE_DIR"); ok {
+		stateDir = sd
+	}
+
 	authOpts, err := openstack.AuthOptionsFromEnv()
 	if err != nil {
 		logrus.Fatal(err)
 	}
 	authOpts.AllowReauth = true
 
-	d, err := NewDriver(authOpts, region, defaultSize, volumePrefix)
+	d, err := NewDriver(authOpts, DriverConfig{
+		Region:       region,
+		DefaultSize:  defaultSize,
+		VolumePrefix: volumePrefix,
+		FsckPolicy:   fsckPolicy,
+		RemovePolicy: removePolicy,
+		StealPolicy:  stealPolicy,
+		StateDir:     stateDir,
+
+		KeyDir:             keyDir,
+		KeyProviderCommand: keyProviderCommand,
+		Readonly:           readonly,
+		DeviceWaitTimeout:  deviceWaitTimeout,
+		Timeouts:           timeouts,
+		IdleDetachTimeout:  idleDetachTimeout,
+	})
 	if err != nil {
 		logrus.Fatal(fmt.Errorf("Could not create CinderDriver: %v.", err))
 	}
 
+	go d.runScheduler()
+	go d.resumeRemovals()
+	go d.resumeRestores()
+	if idleDetachTimeout > 0 {
+		go d.runReaper()
+	}
+
 	h := sdk.NewHandler(`{"Implements": ["VolumeDriver"]}`)
 	setUpHandlers(&h, d)
 
@@ -146,6 +452,21 @@ func main() {
 	}
 }
 
+// lookupTimeout reads a timeout, as a number of seconds, from the env var name.
+func lookupTimeout(name string, defaultTimeout time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return defaultTimeout
+	}
+
+	secs, err := strconv.Atoi(v)
+	if err != nil || secs < 1 {
+		logrus.Fatalf("Provided %s is invalid: expected a positive number of seconds.", name)
+	}
+
+	return time.Duration(secs) * time.Second
+}
+
 func setUpHandlers(h *sdk.Handler, d *CinderDriver) {
 	h.HandleFunc("/VolumeDriver.Create", func(w http.ResponseWriter, r *http.Request) {
 		logger := logrus.WithField("route", "/VolumeDriver.Create")
@@ -160,7 +481,7 @@ func setUpHandlers(h *sdk.Handler, d *CinderDriver) {
 
 		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
 
-		resp := d.Create(logger, req)
+		resp := d.Create(r.Context(), logger, req)
 		if resp.Err != "" {
 			w.WriteHeader(http.StatusBadRequest)
 		}
@@ -180,7 +501,7 @@ func setUpHandlers(h *sdk.Handler, d *CinderDriver) {
 
 		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
 
-		resp := d.Remove(logger, req)
+		resp := d.Remove(r.Context(), logger, req)
 		if resp.Err != "" {
 			w.WriteHeader(http.StatusBadRequest)
 		}
@@ -200,7 +521,7 @@ func setUpHandlers(h *sdk.Handler, d *CinderDriver) {
 
 		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
 
-		resp := d.Mount(logger, req)
+		resp := d.Mount(r.Context(), logger, req)
 		if resp.Err != "" {
 			w.WriteHeader(http.StatusBadRequest)
 		}
@@ -220,7 +541,7 @@ func setUpHandlers(h *sdk.Handler, d *CinderDriver) {
 
 		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
 
-		resp := d.Path(logger, req)
+		resp := d.Path(r.Context(), logger, req)
 		if resp.Err != "" {
 			w.WriteHeader(http.StatusBadRequest)
 		}
@@ -240,7 +561,7 @@ func setUpHandlers(h *sdk.Handler, d *CinderDriver) {
 
 		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
 
-		resp := d.Unmount(logger, req)
+		resp := d.Unmount(r.Context(), logger, req)
 		if resp.Err != "" {
 			w.WriteHeader(http.StatusBadRequest)
 		}
@@ -260,7 +581,7 @@ func setUpHandlers(h *sdk.Handler, d *CinderDriver) {
 
 		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
 
-		resp := d.Get(logger, req)
+		resp := d.Get(r.Context(), logger, req)
 		if resp.Err != "" {
 			w.WriteHeader(http.StatusBadRequest)
 		}
@@ -271,7 +592,327 @@ func setUpHandlers(h *sdk.Handler, d *CinderDriver) {
 		logger := logrus.WithField("route", "/VolumeDriver.List")
 		logger.Debug("New request received")
 
-		resp := d.List(logger)
+		resp := d.List(r.Context(), logger)
+		if resp.Err != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	h.HandleFunc("/Cinder.Resize", func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithField("route", "/Cinder.Resize")
+		logger.Debug("New request received")
+
+		var req VolumeResizeReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
+
+		resp := d.Resize(r.Context(), logger, req)
+		if resp.Err != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	h.HandleFunc("/Cinder.SnapshotCreate", func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithField("route", "/Cinder.SnapshotCreate")
+		logger.Debug("New request received")
+
+		var req SnapshotCreateReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
+
+		resp := d.SnapshotCreate(r.Context(), logger, req)
+		if resp.Err != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	h.HandleFunc("/Cinder.SnapshotList", func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithField("route", "/Cinder.SnapshotList")
+		logger.Debug("New request received")
+
+		var req SnapshotListReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
+
+		resp := d.SnapshotList(r.Context(), logger, req)
+		if resp.Err != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	h.HandleFunc("/Cinder.SnapshotGet", func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithField("route", "/Cinder.SnapshotGet")
+		logger.Debug("New request received")
+
+		var req SnapshotGetReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
+
+		resp := d.SnapshotGet(r.Context(), logger, req)
+		if resp.Err != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	h.HandleFunc("/Cinder.SnapshotRemove", func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithField("route", "/Cinder.SnapshotRemove")
+		logger.Debug("New request received")
+
+		var req SnapshotRemoveReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
+
+		resp := d.SnapshotRemove(r.Context(), logger, req)
+		if resp.Err != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	h.HandleFunc("/Cinder.BackupCreate", func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithField("route", "/Cinder.BackupCreate")
+		logger.Debug("New request received")
+
+		var req BackupCreateReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
+
+		resp := d.BackupCreate(r.Context(), logger, req)
+		if resp.Err != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	h.HandleFunc("/Cinder.BackupList", func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithField("route", "/Cinder.BackupList")
+		logger.Debug("New request received")
+
+		var req BackupListReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
+
+		resp := d.BackupList(r.Context(), logger, req)
+		if resp.Err != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	h.HandleFunc("/Cinder.BackupGet", func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithField("route", "/Cinder.BackupGet")
+		logger.Debug("New request received")
+
+		var req BackupGetReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
+
+		resp := d.BackupGet(r.Context(), logger, req)
+		if resp.Err != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	h.HandleFunc("/Cinder.BackupRemove", func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithField("route", "/Cinder.BackupRemove")
+		logger.Debug("New request received")
+
+		var req BackupRemoveReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
+
+		resp := d.BackupRemove(r.Context(), logger, req)
+		if resp.Err != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	h.HandleFunc("/Cinder.BackupRestore", func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithField("route", "/Cinder.BackupRestore")
+		logger.Debug("New request received")
+
+		var req BackupRestoreReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
+
+		resp := d.BackupRestore(r.Context(), logger, req)
+		if resp.Err != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	h.HandleFunc("/Cinder.RetainedList", func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithField("route", "/Cinder.RetainedList")
+		logger.Debug("New request received")
+
+		var req RetainedListReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
+
+		resp := d.RetainedList(r.Context(), logger, req)
+		if resp.Err != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	h.HandleFunc("/Cinder.RetainedRestore", func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithField("route", "/Cinder.RetainedRestore")
+		logger.Debug("New request received")
+
+		var req RetainedRestoreReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
+
+		resp := d.RetainedRestore(r.Context(), logger, req)
+		if resp.Err != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	h.HandleFunc("/Cinder.TransferCreate", func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithField("route", "/Cinder.TransferCreate")
+		logger.Debug("New request received")
+
+		var req TransferCreateReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
+
+		resp := d.TransferCreate(r.Context(), logger, req)
+		if resp.Err != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	h.HandleFunc("/Cinder.TransferList", func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithField("route", "/Cinder.TransferList")
+		logger.Debug("New request received")
+
+		var req TransferListReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
+
+		resp := d.TransferList(r.Context(), logger, req)
+		if resp.Err != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	h.HandleFunc("/Cinder.TransferAccept", func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithField("route", "/Cinder.TransferAccept")
+		logger.Debug("New request received")
+
+		var req TransferAcceptReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
+
+		resp := d.TransferAccept(r.Context(), logger, req)
+		if resp.Err != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	h.HandleFunc("/Cinder.TransferRemove", func(w http.ResponseWriter, r *http.Request) {
+		logger := logrus.WithField("route", "/Cinder.TransferRemove")
+		logger.Debug("New request received")
+
+		var req TransferRemoveReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithField("Req", fmt.Sprintf("%+v", req))
+
+		resp := d.TransferRemove(r.Context(), logger, req)
 		if resp.Err != "" {
 			w.WriteHeader(http.StatusBadRequest)
 		}
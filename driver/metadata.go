@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+)
+
+// labelOptPrefix prefixes the volume options copied into the metadata of the
+// Block Storage volume, e.g. meta.owner=team-a.
+const labelOptPrefix = "meta."
+
+// metadataPrefixReserved is the namespace of the metadata managed by the
+// plugin. Labels can't be set in there.
+const metadataPrefixReserved = "docker-volume-driver:"
+
+// Cinder limits metadata keys and values to 255 characters.
+const maxMetadataLength = 255
+
+func (o *VolumeCreateOpts) UnmarshalJSON(data []byte) error {
+	// plain has the same fields as VolumeCreateOpts but not this method.
+	type plain VolumeCreateOpts
+	if err := json.Unmarshal(data, (*plain)(o)); err != nil {
+		return err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	for k, v := range raw {
+		if !strings.HasPrefix(k, labelOptPrefix) {
+			continue
+		}
+
+		var value string
+		if err := json.Unmarshal(v, &value); err != nil {
+			return fmt.Errorf("option %s: expected a string", k)
+		}
+
+		if o.Labels == nil {
+			o.Labels = map[string]string{}
+		}
+		o.Labels[strings.TrimPrefix(k, labelOptPrefix)] = value
+	}
+
+	return nil
+}
+
+func validateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		switch {
+		case k == "":
+			return fmt.Errorf("invalid option %s: the label name is missing", labelOptPrefix)
+		case isReservedMetadata(k):
+			return fmt.Errorf("invalid option %s%s: %s is reserved", labelOptPrefix, k, k)
+		case len(k) > maxMetadataLength:
+			return fmt.Errorf("invalid option %s%s: label names are limited to %d characters", labelOptPrefix, k, maxMetadataLength)
+		case len(v) > maxMetadataLength:
+			return fmt.Errorf("invalid option %s%s: label values are limited to %d characters", labelOptPrefix, k, maxMetadataLength)
+		}
+	}
+
+	return nil
+}
+
+// isReservedMetadata returns whether key is managed either by the plugin or by
+// Cinder itself.
+func isReservedMetadata(key string) bool {
+	return strings.HasPrefix(key, metadataPrefixReserved) || key == metadataFieldCinderReadonly || key == "attached_mode"
+}
+
+// volumeLabels returns the metadata of vol which isn't managed by the plugin.
+func volumeLabels(vol volumes.Volume) map[string]string {
+	labels := map[string]string{}
+	for k, v := range vol.Metadata {
+		if !isReservedMetadata(k) {
+			labels[k] = v
+		}
+	}
+
+	return labels
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestVolumeCreateOptsUnmarshalJSON(t *testing.T) {
+	tcs := []struct {
+		name     string
+		data     string
+		size     string
+		expected map[string]string
+		err      bool
+	}{
+		{
+			name:     "no labels",
+			data:     `{"size": "10"}`,
+			size:     "10",
+			expected: nil,
+		},
+		{
+			name:     "labels",
+			data:     `{"size": "10", "meta.owner": "team-a", "meta.cost-center": "42"}`,
+			size:     "10",
+			expected: map[string]string{"owner": "team-a", "cost-center": "42"},
+		},
+		{
+			name:     "prefix only",
+			data:     `{"meta.": "x"}`,
+			expected: map[string]string{"": "x"},
+		},
+		{
+			name:     "prefix in the middle",
+			data:     `{"x.meta.owner": "team-a"}`,
+			expected: nil,
+		},
+		{
+			name: "not a string",
+			data: `{"meta.replicas": 3}`,
+			err:  true,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			var opts VolumeCreateOpts
+			err := json.Unmarshal([]byte(tc.data), &opts)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", opts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if opts.Size != tc.size {
+				t.Errorf("expected size %q, got %q", tc.size, opts.Size)
+			}
+			if !maps.Equal(opts.Labels, tc.expected) || (opts.Labels == nil) != (tc.expected == nil) {
+				t.Errorf("expected labels %v, got %v", tc.expected, opts.Labels)
+			}
+		})
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	tcs := []struct {
+		name   string
+		labels map[string]string
+		err    bool
+	}{
+		{name: "none", labels: nil},
+		{name: "valid", labels: map[string]string{"owner": "team-a", "cost-center": ""}},
+		{name: "missing name", labels: map[string]string{"": "x"}, err: true},
+		{name: "plugin metadata", labels: map[string]string{metadataPrefixReserved + "fs": "xfs"}, err: true},
+		{name: "plugin namespace", labels: map[string]string{metadataPrefixReserved: "x"}, err: true},
+		{name: "cinder readonly flag", labels: map[string]string{"readonly": "true"}, err: true},
+		{name: "cinder attached mode", labels: map[string]string{"attached_mode": "rw"}, err: true},
+		{name: "similar to reserved", labels: map[string]string{"readonly-copy": "true"}},
+		{name: "long name", labels: map[string]string{strings.Repeat("k", maxMetadataLength+1): "x"}, err: true},
+		{name: "long value", labels: map[string]string{"owner": strings.Repeat("v", maxMetadataLength+1)}, err: true},
+		{name: "longest name and value", labels: map[string]string{strings.Repeat("k", maxMetadataLength): strings.Repeat("v", maxMetadataLength)}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateLabels(tc.labels)
+			if tc.err && err == nil {
+				t.Fatal("expected an error")
+			} else if !tc.err && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/sirupsen/logrus"
+)
+
+const partitionAuto = "auto"
+
+func validatePartition(partition string) error {
+	if partition == "" || partition == partitionAuto {
+		return nil
+	}
+
+	if n, err := strconv.Atoi(partition); err != nil || n < 1 {
+		return fmt.Errorf("invalid partition %s (expected either %s or a partition number)", partition, partitionAuto)
+	}
+
+	return nil
+}
+
+// resolvePartition returns the partition of disk holding the data of vol. When
+// create is true, i.e. when the current server is the only one writing to
+// disk, a GPT with a single partition is created on blank disks, and the
+// partition is grown along with the volume.
+func (d *CinderDriver) resolvePartition(logger *logrus.Entry, vol volumes.Volume, disk string, create bool) (string, error) {
+	partition := vol.Metadata[metadataFieldPartition]
+	if err := validatePartition(partition); err != nil {
+		return "", fmt.Errorf("reading %s: %v", metadataFieldPartition, err)
+	}
+
+	blk, err := probeDevice(disk)
+	if err != nil {
+		return "", err
+	}
+
+	if blk.Children == nil {
+		if blk.FSType != "" {
+			return "", fmt.Errorf("device %s has no partition table but a %s filesystem", disk, blk.FSType)
+		}
+		if !create {
+			return "", fmt.Errorf("device %s has no partition table", disk)
+		}
+		if partition != partitionAuto && partition != "1" {
+			return "", fmt.Errorf("device %s is blank, only partition 1 can be created", disk)
+		}
+
+		logger.Info("No partition table detected. Creating a GPT with a single partition...")
+
+		if blk, err = createPartitionTable(disk); err != nil {
+			return "", err
+		}
+	}
+
+	var part blockDevice
+	if partition == partitionAuto {
+		part, err = pickPartition(vol, disk, blk.Children)
+	} else {
+		part, err = findPartition(disk, blk.Children, partition)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := refreshDeviceSize(disk, vol.Size); err != nil {
+		return "", err
+	}
+
+	fsType, err := getFSMetadata(vol)
+	if err != nil {
+		return "", err
+	}
+
+	// Cluster filesystems are written to by every server, none of which can
+	// rewrite the partition table under the others. Other partition tables
+	// than GPT (e.g. MBR) aren't grown, as their layout might not allow it.
+	if !create || (isShared(vol) && filesystems[fsType].cluster) {
+		logger.Debugf("Not growing partition %s, the disk is opened in read-only mode or written to by other servers.", part.Name)
+	} else if blk.PTType != "gpt" {
+		logger.Debugf("Not growing partition %s, the partition table of %s isn't a GPT (%s).", part.Name, disk, blk.PTType)
+	} else if err := growPartitionIfNeeded(logger, disk, part.Name); err != nil {
+		logger.Warnf("Could not grow partition %s: %v", part.Name, err)
+	}
+
+	return path.Join("/dev", part.Name), nil
+}
+
+// pickPartition returns the only partition holding the kind of data expected
+// for vol, or the only partition if none does.
+func pickPartition(vol volumes.Volume, disk string, parts []blockDevice) (blockDevice, error) {
+	expected, err := getFSMetadata(vol)
+	if err != nil {
+		return blockDevice{}, err
+	}
+	if isEncrypted(vol) {
+		expected = "crypto_LUKS"
+	}
+
+	matching := make([]blockDevice, 0, 1)
+	for _, part := range parts {
+		if part.FSType == expected {
+			matching = append(matching, part)
+		}
+	}
+
+	switch {
+	case len(matching) == 1:
+		return matching[0], nil
+	case len(matching) > 1:
+		return blockDevice{}, fmt.Errorf("device %s has %d partitions holding %s, partition number should be specified", disk, len(matching), expected)
+	case len(parts) == 1:
+		return parts[0], nil
+	}
+
+	return blockDevice{}, fmt.Errorf("device %s has no partition holding %s", disk, expected)
+}
+
+func findPartition(disk string, parts []blockDevice, partition string) (blockDevice, error) {
+	for _, part := range parts {
+		content, err := os.ReadFile(path.Join("/sys/class/block", part.Name, "partition"))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return blockDevice{}, fmt.Errorf("reading partition number of %s: %v", part.Name, err)
+		}
+
+		if strings.TrimSpace(string(content)) == partition {
+			return part, nil
+		}
+	}
+
+	return blockDevice{}, fmt.Errorf("device %s has no partition %s", disk, partition)
+}
+
+// createPartitionTable writes a GPT with a single Linux partition spanning the
+// whole disk, and waits for the kernel to expose that partition.
+func createPartitionTable(disk string) (blockDevice, error) {
+	cmd := exec.Command("sfdisk", "--quiet", disk)
+	cmd.Stdin = strings.NewReader("label: gpt\n,,L\n")
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return blockDevice{}, fmt.Errorf("sfdisk on %s failed: %v: %s", disk, err, strings.TrimSpace(string(output)))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		blk, err := probeDevice(disk)
+		if err != nil {
+			return blockDevice{}, err
+		}
+		if len(blk.Children) > 0 {
+			return blk, nil
+		}
+		if time.Now().After(deadline) {
+			return blockDevice{}, fmt.Errorf("partition created on %s didn't show up", disk)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// growPartitionIfNeeded extends part to the end of disk when it's the last
+// partition and the disk was extended.
+func growPartitionIfNeeded(logger *logrus.Entry, disk, part string) error {
+	diskSize, err := deviceSize(disk)
+	if err != nil {
+		return err
+	}
+
+	start, err := readSysBlockInt(path.Join("/sys/class/block", part, "start"))
+	if err != nil {
+		return err
+	}
+	size, err := readSysBlockInt(path.Join("/sys/class/block", part, "size"))
+	if err != nil {
+		return err
+	}
+
+	// start and size are expressed in 512-byte sectors.
+	if diskSize-(start+size)*512 < growThreshold {
+		return nil
+	}
+
+	number, err := readSysBlockInt(path.Join("/sys/class/block", part, "partition"))
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Partition %s doesn't span the whole device. Growing...", part)
+
+	// sfdisk refuses to move the backup GPT header by itself.
+	if output, err := exec.Command("sfdisk", "--relocate", "gpt-bak-std", disk).CombinedOutput(); err != nil {
+		return fmt.Errorf("relocating GPT backup header on %s failed: %v: %s", disk, err, strings.TrimSpace(string(output)))
+	}
+
+	cmd := exec.Command("sfdisk", "--quiet", "--no-reread", "-N", strconv.FormatInt(number, 10), disk)
+	cmd.Stdin = strings.NewReader(",+\n")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sfdisk on %s failed: %v: %s", disk, err, strings.TrimSpace(string(output)))
+	}
+
+	// The partition is in use, so the whole table can't be reread.
+	if output, err := exec.Command("partx", "--update", "--nr", strconv.FormatInt(number, 10), disk).CombinedOutput(); err != nil {
+		return fmt.Errorf("partx on %s failed: %v: %s", disk, err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+func readSysBlockInt(file string) (int64, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return 0, fmt.Errorf("reading %s: %v", file, err)
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %v", file, err)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+)
+
+func TestPickPartition(t *testing.T) {
+	ext4 := volumes.Volume{Name: "data", Metadata: map[string]string{}}
+	xfs := volumes.Volume{Name: "data", Metadata: map[string]string{metadataFieldFS: "xfs"}}
+	encrypted := volumes.Volume{Name: "data", Metadata: map[string]string{metadataFieldEncrypted: "true"}}
+
+	tcs := []struct {
+		name     string
+		vol      volumes.Volume
+		parts    []blockDevice
+		expected string
+		err      bool
+	}{
+		{
+			name:     "single matching partition",
+			vol:      ext4,
+			parts:    []blockDevice{{Name: "vdb1", FSType: "vfat"}, {Name: "vdb2", FSType: "ext4"}},
+			expected: "vdb2",
+		},
+		{
+			name:     "filesystem from metadata",
+			vol:      xfs,
+			parts:    []blockDevice{{Name: "vdb1", FSType: "ext4"}, {Name: "vdb2", FSType: "xfs"}},
+			expected: "vdb2",
+		},
+		{
+			name:     "encrypted volume",
+			vol:      encrypted,
+			parts:    []blockDevice{{Name: "vdb1", FSType: "ext4"}, {Name: "vdb2", FSType: "crypto_LUKS"}},
+			expected: "vdb2",
+		},
+		{
+			name:     "single blank partition",
+			vol:      ext4,
+			parts:    []blockDevice{{Name: "vdb1"}},
+			expected: "vdb1",
+		},
+		{
+			name:  "several matching partitions",
+			vol:   ext4,
+			parts: []blockDevice{{Name: "vdb1", FSType: "ext4"}, {Name: "vdb2", FSType: "ext4"}},
+			err:   true,
+		},
+		{
+			name:  "no matching partition",
+			vol:   ext4,
+			parts: []blockDevice{{Name: "vdb1", FSType: "vfat"}, {Name: "vdb2", FSType: "swap"}},
+			err:   true,
+		},
+		{
+			name: "no partition",
+			vol:  ext4,
+			err:  true,
+		},
+		{
+			name:  "unsupported filesystem",
+			vol:   volumes.Volume{Name: "data", Metadata: map[string]string{metadataFieldFS: "vfat"}},
+			parts: []blockDevice{{Name: "vdb1", FSType: "vfat"}},
+			err:   true,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			part, err := pickPartition(tc.vol, "/dev/vdb", tc.parts)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", part.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if part.Name != tc.expected {
+				t.Fatalf("expected %s, got %s", tc.expected, part.Name)
+			}
+		})
+	}
+}
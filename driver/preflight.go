@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/availabilityzones"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/limits"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumetypes"
+	"github.com/sirupsen/logrus"
+)
+
+// preflightCreate checks the volume type, the availability zone and the
+// project limits before creating a volume, as Cinder either returns obscure
+// errors or leaves a volume in error status behind when they're wrong. Checks
+// which can't be done, e.g. because the cloud policy forbids listing AZs, are
+// skipped.
+func (d *CinderDriver) preflightCreate(logger *logrus.Entry, opts volumes.CreateOpts) error {
+	if opts.VolumeType != "" {
+		if err := d.checkVolumeType(opts.VolumeType); err != nil {
+			if _, ok := err.(preflightError); ok {
+				return err
+			}
+			logger.Warnf("Skipping the volume type check: %v", err)
+		}
+	}
+
+	if opts.AvailabilityZone != "" {
+		if err := d.checkAvailabilityZone(opts.AvailabilityZone); err != nil {
+			if _, ok := err.(preflightError); ok {
+				return err
+			}
+			logger.Warnf("Skipping the availability zone check: %v", err)
+		}
+	}
+
+	if err := d.checkLimits(opts.Size); err != nil {
+		if _, ok := err.(preflightError); ok {
+			return err
+		}
+		logger.Warnf("Skipping the project limits check: %v", err)
+	}
+
+	return nil
+}
+
+// preflightError is returned when an option is known to be wrong, as opposed
+// to errors preventing the check itself.
+type preflightError struct {
+	msg string
+}
+
+func (e preflightError) Error() string {
+	return e.msg
+}
+
+func (d *CinderDriver) checkVolumeType(volumeType string) error {
+	allPages, err := volumetypes.List(d.storageClient, nil).AllPages()
+	if err != nil {
+		return fmt.Errorf("listing volume types: %v", err)
+	}
+
+	types, err := volumetypes.ExtractVolumeTypes(allPages)
+	if err != nil {
+		return fmt.Errorf("extracting volume types from api response: %v", err)
+	}
+
+	names := make([]string, 0, len(types))
+	for _, t := range types {
+		if t.Name == volumeType || t.ID == volumeType {
+			return nil
+		}
+		names = append(names, t.Name)
+	}
+
+	return preflightError{fmt.Sprintf("volume type %s doesn't exist (available types: %s)", volumeType, strings.Join(names, ", "))}
+}
+
+func (d *CinderDriver) checkAvailabilityZone(az string) error {
+	allPages, err := availabilityzones.List(d.storageClient).AllPages()
+	if err != nil {
+		return fmt.Errorf("listing availability zones: %v", err)
+	}
+
+	zones, err := availabilityzones.ExtractAvailabilityZones(allPages)
+	if err != nil {
+		return fmt.Errorf("extracting availability zones from api response: %v", err)
+	}
+
+	names := make([]string, 0, len(zones))
+	for _, zone := range zones {
+		if zone.ZoneName != az {
+			if zone.ZoneState.Available {
+				names = append(names, zone.ZoneName)
+			}
+			continue
+		}
+
+		if !zone.ZoneState.Available {
+			return preflightError{fmt.Sprintf("availability zone %s is currently unavailable", az)}
+		}
+		return nil
+	}
+
+	return preflightError{fmt.Sprintf("availability zone %s doesn't exist (available zones: %s)", az, strings.Join(names, ", "))}
+}
+
+// checkLimits makes sure the project can hold one more volume of size GB. Limits
+// set to -1 are unlimited.
+func (d *CinderDriver) checkLimits(size int) error {
+	l, err := limits.Get(d.storageClient).Extract()
+	if err != nil {
+		return fmt.Errorf("getting project limits: %v", err)
+	}
+
+	abs := l.Absolute
+	if abs.MaxTotalVolumes >= 0 && abs.TotalVolumesUsed+1 > abs.MaxTotalVolumes {
+		return preflightError{fmt.Sprintf("volume quota exceeded: %d of %d volumes are already used", abs.TotalVolumesUsed, abs.MaxTotalVolumes)}
+	}
+	if abs.MaxTotalVolumeGigabytes >= 0 && abs.TotalGigabytesUsed+size > abs.MaxTotalVolumeGigabytes {
+		return preflightError{fmt.Sprintf("gigabytes quota exceeded: %d GB requested but only %d of %d GB are left", size, abs.MaxTotalVolumeGigabytes-abs.TotalGigabytesUsed, abs.MaxTotalVolumeGigabytes)}
+	}
+
+	return nil
+}
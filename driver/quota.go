@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/sirupsen/logrus"
+)
+
+// datadirProject is the project ID assigned to the datadir of volumes with a
+// quota. Sub-volumes get the next free project IDs.
+const datadirProject = 1
+
+// quotaSuffixes maps the suffixes accepted by the quota option to their
+// multiplier.
+var quotaSuffixes = map[string]int64{
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// parseQuota parses a size limit such as 512M or 10G into a number of bytes.
+func parseQuota(quota string) (int64, error) {
+	value, mult := strings.ToUpper(quota), int64(1)
+	for suffix, m := range quotaSuffixes {
+		if strings.HasSuffix(value, suffix) {
+			value, mult = strings.TrimSuffix(value, suffix), m
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid quota %s (expected a positive size, e.g. 512M or 10G)", quota)
+	}
+
+	return n * mult, nil
+}
+
+// validateQuota makes sure quota can be enforced on a filesystem of type fsType.
+func validateQuota(fsType, quota string) error {
+	if _, err := parseQuota(quota); err != nil {
+		return err
+	}
+	if fsType != "ext4" && fsType != "xfs" {
+		return fmt.Errorf("quotas aren't supported on %s filesystems", fsType)
+	}
+
+	return nil
+}
+
+// needsProjectQuota returns whether the filesystem of vol should be mounted
+// with project quotas, i.e. when it or one of its sub-volumes has a quota.
+func needsProjectQuota(vol volumes.Volume) (bool, error) {
+	if vol.Metadata[metadataFieldQuota] != "" {
+		return true, nil
+	}
+
+	subs, err := subVolumes(vol)
+	if err != nil {
+		return false, err
+	}
+
+	return slices.ContainsFunc(subs, func(sub subVolume) bool { return sub.Quota != "" }), nil
+}
+
+// enableProjectQuota turns on the filesystem features needed for project
+// quotas. It must be called while the filesystem isn't mounted.
+func enableProjectQuota(logger *logrus.Entry, dev, fsType string) error {
+	// XFS only needs the prjquota mount option.
+	if fsType != "ext4" {
+		return nil
+	}
+
+	output, err := exec.Command("dumpe2fs", "-h", dev).Output()
+	if err != nil {
+		return fmt.Errorf("dumpe2fs on %s failed: %v", dev, err)
+	}
+
+	var features []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if key, value, _ := strings.Cut(line, ":"); key == "Filesystem features" {
+			features = strings.Fields(value)
+		}
+	}
+
+	if slices.Contains(features, "quota") && slices.Contains(features, "project") {
+		return nil
+	}
+
+	logger.Info("Enabling project quotas on the filesystem...")
+
+	if output, err := exec.Command("tune2fs", "-O", "quota,project", dev).CombinedOutput(); err != nil {
+		return fmt.Errorf("tune2fs on %s failed: %v: %s", dev, err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// hasProjectQuota returns whether the filesystem mounted on mountpoint enforces
+// project quotas.
+func hasProjectQuota(mountpoint string) (bool, error) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return false, fmt.Errorf("opening /proc/mounts: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		w := strings.Split(scanner.Text(), " ")
+		if len(w) < 4 || w[1] != mountpoint {
+			continue
+		}
+
+		return slices.Contains(strings.Split(w[3], ","), "prjquota"), nil
+	}
+
+	return false, scanner.Err()
+}
+
+// setProjectQuota assigns project to dir and limits the space used by that
+// project on the filesystem mounted on mountpoint. A limit of 0 lifts it.
+func setProjectQuota(mountpoint, dir, fsType string, project int, limit int64) error {
+	if ok, err := hasProjectQuota(mountpoint); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("project quotas aren't enabled on %s, the volume has to be unmounted and mounted again", mountpoint)
+	}
+
+	if dir != "" {
+		if err := assignProject(mountpoint, dir, fsType, project); err != nil {
+			return err
+		}
+	}
+
+	// Limits are expressed in KiB to avoid any ambiguity about units.
+	return xfsQuota(mountpoint, fsType, fmt.Sprintf("limit -p bhard=%dk %d", (limit+1023)/1024, project))
+}
+
+// assignProject assigns project to dir and everything it holds. Files created
+// in dir later on inherit its project ID. This walks the whole tree, so it's
+// skipped when dir already has that project.
+func assignProject(mountpoint, dir, fsType string, project int) error {
+	output, err := exec.Command("lsattr", "-d", "-p", dir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("lsattr on %s failed: %v: %s", dir, err, strings.TrimSpace(string(output)))
+	}
+
+	if current, inherit, err := parseLsattrProject(string(output)); err != nil {
+		return err
+	} else if current == project && inherit {
+		return nil
+	}
+
+	if fsType == "xfs" {
+		return xfsQuota(mountpoint, fsType, fmt.Sprintf("project -s -p %s %d", dir, project))
+	}
+
+	if output, err := exec.Command("chattr", "-R", "-p", strconv.Itoa(project), "+P", dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("chattr on %s failed: %v: %s", dir, err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// parseLsattrProject parses the output of lsattr -d -p, e.g.
+// "    1 --------------e-------P-- /data", into the project ID of the
+// directory and whether its files inherit it.
+func parseLsattrProject(output string) (int, bool, error) {
+	fields := strings.Fields(output)
+	if len(fields) < 3 {
+		return 0, false, fmt.Errorf("unexpected lsattr output: %s", strings.TrimSpace(output))
+	}
+
+	project, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, false, fmt.Errorf("parsing lsattr output: %v", err)
+	}
+
+	return project, strings.Contains(fields[1], "P"), nil
+}
+
+// getProjectQuota returns the space used by project and its limit, in bytes.
+func getProjectQuota(mountpoint, fsType string, project int) (int64, int64, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := xfsQuotaCmd(mountpoint, fsType, fmt.Sprintf("quota -p -N -b -n %d", project))
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	if err := cmd.Run(); err != nil || stderr.Len() > 0 {
+		return 0, 0, fmt.Errorf("xfs_quota on %s failed: %v: %s", mountpoint, err, strings.TrimSpace(stderr.String()))
+	}
+
+	// The output is made of the device, the used blocks, the soft and the hard
+	// limits, in KiB. Long device names are followed by a line break, hence
+	// the whole output is split.
+	fields := strings.Fields(stdout.String())
+	if len(fields) == 0 {
+		return 0, 0, nil
+	}
+	if len(fields) < 4 {
+		return 0, 0, fmt.Errorf("unexpected xfs_quota output: %s", strings.TrimSpace(stdout.String()))
+	}
+
+	used, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parsing xfs_quota output: %v", err)
+	}
+	limit, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parsing xfs_quota output: %v", err)
+	}
+
+	return used * 1024, limit * 1024, nil
+}
+
+// quotaStatus returns the usage of project, as reported in VolumeGetResp.
+func quotaStatus(mountpoint, fsType string, project int) (map[string]interface{}, error) {
+	used, limit, err := getProjectQuota(mountpoint, fsType, project)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"Project": project,
+		"Used":    used,
+		"Limit":   limit,
+	}, nil
+}
+
+// xfsQuota runs an xfs_quota command in expert mode. xfs_quota doesn't always
+// exit with an error status, so anything printed on stderr is an error.
+func xfsQuota(mountpoint, fsType, command string) error {
+	var stderr bytes.Buffer
+	cmd := xfsQuotaCmd(mountpoint, fsType, command)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil || stderr.Len() > 0 {
+		return fmt.Errorf("xfs_quota %q on %s failed: %v: %s", command, mountpoint, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+func xfsQuotaCmd(mountpoint, fsType, command string) *exec.Cmd {
+	args := []string{"-x", "-c", command, mountpoint}
+	// Other filesystems are only handled in foreign mode.
+	if fsType != "xfs" {
+		args = append([]string{"-f"}, args...)
+	}
+
+	return exec.Command("xfs_quota", args...)
+}
+
+// addQuotaStatus adds the usage of project to status when the filesystem of vol
+// is mounted on this server.
+func (d *CinderDriver) addQuotaStatus(logger *logrus.Entry, status map[string]interface{}, vol volumes.Volume, project int) {
+	mountpoint := path.Join(propagatedMount, vol.ID)
+	if ok, err := isMounted(mountpoint); err != nil || !ok {
+		return
+	}
+
+	fsType, err := getFSMetadata(vol)
+	if err != nil {
+		return
+	}
+
+	quota, err := quotaStatus(mountpoint, fsType, project)
+	if err != nil {
+		logger.Warnf("Could not read the quota of project %d: %v", project, err)
+		return
+	}
+
+	status["Quota"] = quota
+}
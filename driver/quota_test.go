@@ -0,0 +1,78 @@
+package main
+
+import "testing"
+
+func TestParseQuota(t *testing.T) {
+	tcs := []struct {
+		quota    string
+		expected int64
+		err      bool
+	}{
+		{quota: "1024", expected: 1024},
+		{quota: "512K", expected: 512 << 10},
+		{quota: "512M", expected: 512 << 20},
+		{quota: "10G", expected: 10 << 30},
+		{quota: "10g", expected: 10 << 30},
+		{quota: "2T", expected: 2 << 40},
+		{quota: "0", err: true},
+		{quota: "0G", err: true},
+		{quota: "-1G", err: true},
+		{quota: "", err: true},
+		{quota: "G", err: true},
+		{quota: "10GB", err: true},
+		{quota: "1.5G", err: true},
+		{quota: "ten", err: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.quota, func(t *testing.T) {
+			got, err := parseQuota(tc.quota)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.expected {
+				t.Fatalf("expected %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseLsattrProject(t *testing.T) {
+	tcs := []struct {
+		output  string
+		project int
+		inherit bool
+		err     bool
+	}{
+		{output: "    1 --------------e-------P-- /mnt/data\n", project: 1, inherit: true},
+		{output: "    0 --------------e---------- /mnt/data\n", project: 0, inherit: false},
+		{output: "   42 ----------------------P-- /mnt/volumes/a b\n", project: 42, inherit: true},
+		{output: "", err: true},
+		{output: "lsattr: Operation not supported", err: true},
+	}
+
+	for _, tc := range tcs {
+		project, inherit, err := parseLsattrProject(tc.output)
+		if tc.err {
+			if err == nil {
+				t.Errorf("parseLsattrProject(%q): expected an error", tc.output)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseLsattrProject(%q): unexpected error: %v", tc.output, err)
+			continue
+		}
+
+		if project != tc.project || inherit != tc.inherit {
+			t.Errorf("parseLsattrProject(%q): expected %d, %t, got %d, %t", tc.output, tc.project, tc.inherit, project, inherit)
+		}
+	}
+}
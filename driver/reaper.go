@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/sirupsen/logrus"
+)
+
+// reaperInterval is how often volumes left attached after being unmounted are
+// looked for.
+const reaperInterval = time.Minute
+
+// runReaper detaches the volumes left attached to the current server after
+// being unmounted, once they've been idle for idleDetachTimeout. It never
+// returns.
+func (d *CinderDriver) runReaper() {
+	logger := logrus.WithField("component", "reaper")
+
+	for {
+		time.Sleep(reaperInterval)
+
+		d.reapIdleVolumes(logger)
+	}
+}
+
+func (d *CinderDriver) reapIdleVolumes(logger *logrus.Entry) {
+	vols, err := d.listVolumes()
+	if err != nil {
+		logger.Errorf("Could not list volumes: %v", err)
+		return
+	}
+
+	for _, vol := range vols {
+		if !isAttachedTo(vol, d.serverID) || !d.isIdle(vol) {
+			continue
+		}
+		if mounted, err := d.isMountedLocally(vol); err != nil || mounted {
+			continue
+		}
+
+		if err := d.reapVolume(logger.WithField("VolID", vol.ID), vol); err != nil {
+			logger.Errorf("Could not detach idle volume %s: %v", vol.Name, err)
+		}
+	}
+}
+
+// isIdle returns whether vol was unmounted more than idleDetachTimeout ago.
+// Volumes never unmounted since the plugin tracks unmounts are left alone.
+func (d *CinderDriver) isIdle(vol volumes.Volume) bool {
+	lastUnmount := d.state.get(vol.ID).LastUnmount
+
+	return !lastUnmount.IsZero() && time.Since(lastUnmount) > d.idleDetachTimeout
+}
+
+// reapVolume detaches vol from the current server, unless it has been mounted
+// again in the meantime.
+func (d *CinderDriver) reapVolume(logger *logrus.Entry, vol volumes.Volume) error {
+	unlock := d.locks.lock(vol.ID)
+	defer unlock()
+
+	// The volume might have been mounted or detached while waiting for the
+	// lock.
+	fresh, err := volumes.Get(d.storageClient, vol.ID).Extract()
+	if err != nil {
+		return fmt.Errorf("getting volume: %v", err)
+	}
+	vol = *fresh
+	if !isAttachedTo(vol, d.serverID) || !d.isIdle(vol) {
+		return nil
+	}
+
+	if _, running := d.snapshotting.Load(vol.ID); running {
+		logger.Debugf("Not detaching volume %s while it's being snapshotted.", vol.Name)
+		return nil
+	}
+
+	if mounted, err := d.isMountedLocally(vol); err != nil {
+		return fmt.Errorf("checking if volume is mounted: %v", err)
+	} else if mounted {
+		return nil
+	}
+
+	if err := closeEncrypted(vol); err != nil {
+		return fmt.Errorf("closing encrypted volume: %v", err)
+	}
+
+	if err := d.detachVolume(context.Background(), logger, vol, false, true); err != nil {
+		return err
+	}
+
+	logger.Infof("Volume %s has been detached after being idle for %s.", vol.Name, d.idleDetachTimeout)
+
+	return nil
+}
+
+// isMountedLocally returns whether vol or its sub-volumes are mounted on the
+// current server. Block volumes are exposed through a link, and filesystems
+// stay mounted while sub-volumes are.
+func (d *CinderDriver) isMountedLocally(vol volumes.Volume) (bool, error) {
+	if mountpoint, err := d.userMountpoint(vol); err != nil || mountpoint != "" {
+		return mountpoint != "", err
+	}
+
+	return isMounted(path.Join(propagatedMount, vol.ID))
+}
+
+// recordUnmount records when vol was last unmounted, for the reaper.
+func (d *CinderDriver) recordUnmount(logger *logrus.Entry, vol volumes.Volume) {
+	if err := d.state.update(vol.ID, func(st *volumeState) { st.LastUnmount = time.Now().UTC() }); err != nil {
+		logger.Warnf("Could not record the unmount of volume %s: %v", vol.Name, err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/volumeactions"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/sirupsen/logrus"
+)
+
+// extendInUseMicroversion is the first Block Storage API microversion allowing
+// to extend volumes attached to a server.
+const extendInUseMicroversion = "3.42"
+
+func (d *CinderDriver) Resize(ctx context.Context, logger *logrus.Entry, req VolumeResizeReq) VolumeResizeResp {
+	resp := VolumeResizeResp{}
+
+	vol, err := d.findVolume(req.Name)
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	logger = logger.WithField("VolID", vol.ID)
+
+	unlock := d.locks.lock(vol.ID)
+	defer unlock()
+
+	if req.Size <= vol.Size {
+		resp.Err = fmt.Sprintf("new size (%d GB) should be greater than the current size of volume %s (%d GB)", req.Size, req.Name, vol.Size)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	client := *d.storageClient
+	client.Microversion = extendInUseMicroversion
+
+	opts := volumeactions.ExtendSizeOpts{NewSize: req.Size}
+	if err := volumeactions.ExtendSize(&client, vol.ID, opts).ExtractErr(); err != nil {
+		resp.Err = fmt.Sprintf("could not extend volume %s: %v", req.Name, err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	if err := d.waitForVolumeSize(ctx, vol.ID, req.Size, d.timeouts.Extend); err != nil {
+		resp.Err = fmt.Sprintf("error waiting for volume %s to be extended: %v", req.Name, err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	logger.Infof("Volume %s has been extended to %d GB.", req.Name, req.Size)
+	vol.Size = req.Size
+
+	if readonly, err := d.isReadonly(vol); err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	} else if readonly {
+		return resp
+	}
+
+	// When the volume isn't mounted on this server, the filesystem will be grown
+	// by the next Mount(). The filesystem might also be mounted for sub-volumes.
+	mountpoint := path.Join(propagatedMount, vol.ID)
+	active, err := isMounted(mountpoint)
+	if isBlockMode(vol) {
+		var link string
+		link, err = d.userMountpoint(vol)
+		active = link != ""
+	}
+	if err != nil {
+		resp.Err = fmt.Sprintf("checking if volume %s is mounted: %v", req.Name, err)
+		logger.Error(resp.Err)
+
+		return resp
+	} else if !active {
+		return resp
+	}
+
+	dev, err := findDevWithSerial(vol.ID)
+	if err != nil {
+		resp.Err = fmt.Sprintf("could not find the device of volume %s: %v", req.Name, err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	// Shared volumes are grown by the server mounting them in read-write mode.
+	if !isBlockMode(vol) {
+		if ro, err := isMountedReadonly(mountpoint); err != nil {
+			resp.Err = err.Error()
+			logger.Error(resp.Err)
+
+			return resp
+		} else if ro {
+			return resp
+		}
+	}
+
+	// Partitions and LUKS mappings are grown when opening them. The device is
+	// in use, so it's never initialized.
+	if dev, err = d.openDevice(logger, vol, dev, true, false); err != nil {
+		resp.Err = fmt.Sprintf("could not open the device of volume %s: %v", req.Name, err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	if isBlockMode(vol) {
+		return resp
+	}
+
+	fsType, err := getFSMetadata(vol)
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	if err := growIfNeeded(logger, dev, mountpoint, fsType, req.Size); err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	return resp
+}
+
+func (d *CinderDriver) waitForVolumeSize(ctx context.Context, volID string, size int, timeout time.Duration) error {
+	return waitFor(ctx, timeout, func() (bool, error) {
+		vol, err := volumes.Get(d.storageClient, volID).Extract()
+		if err != nil {
+			return false, err
+		}
+
+		if vol.Status == "error_extending" {
+			return false, fmt.Errorf("volume is in %s status", vol.Status)
+		}
+
+		return vol.Size == size && vol.Status != "extending", nil
+	})
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/backups"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	removeDelete = "delete"
+	removeRetain = "retain"
+	removeBackup = "backup"
+)
+
+// metadataFieldRemovedAt is set on the volumes retained by Remove(). Such
+// volumes are hidden from Podman until they're restored.
+const metadataFieldRemovedAt = "docker-volume-driver:removed-at"
+
+// metadataFieldRemoveBackup is the ID of the backup of a volume removed with
+// the backup policy, which is deleted once that backup is available.
+const metadataFieldRemoveBackup = "docker-volume-driver:remove-backup"
+
+func validateRemovePolicy(policy string) error {
+	switch policy {
+	case removeDelete, removeRetain, removeBackup:
+		return nil
+	}
+
+	return fmt.Errorf("invalid remove policy %s (expected either %s, %s or %s)", policy, removeDelete, removeRetain, removeBackup)
+}
+
+func isRemoved(vol volumes.Volume) bool {
+	return vol.Metadata[metadataFieldRemovedAt] != ""
+}
+
+// volumeRemovePolicy returns the remove policy of vol, falling back to
+// REMOVE_POLICY.
+func (d *CinderDriver) volumeRemovePolicy(vol volumes.Volume) (string, error) {
+	policy := vol.Metadata[metadataFieldRemovePolicy]
+	if policy == "" {
+		return d.removePolicy, nil
+	}
+
+	if err := validateRemovePolicy(policy); err != nil {
+		return "", fmt.Errorf("reading %s: %v", metadataFieldRemovePolicy, err)
+	}
+
+	return policy, nil
+}
+
+// finalBackupTimeout bounds how long the final backups of volumes removed with
+// the backup policy are waited for, before deleting the volumes.
+const finalBackupTimeout = 24 * time.Hour
+
+// retainVolume hides vol from Podman instead of deleting it.
+func (d *CinderDriver) retainVolume(logger *logrus.Entry, vol volumes.Volume) error {
+	now := time.Now().UTC()
+	if err := d.updateMetadata(vol.ID, map[string]string{metadataFieldRemovedAt: now.Format(time.RFC3339)}); err != nil {
+		return fmt.Errorf("tagging volume %s as removed: %v", vol.Name, err)
+	}
+
+	logger.Infof("Volume %s has been retained.", vol.Name)
+
+	return nil
+}
+
+// backUpAndDeleteVolume backs vol up, then deletes it. Backups might take
+// hours, so vol is retained meanwhile, and deleted in the background once the
+// backup is available. The backup is recorded in the metadata of vol, so the
+// deletion is resumed if the plugin restarts in the meantime. vol is left
+// retained if the backup fails.
+func (d *CinderDriver) backUpAndDeleteVolume(logger *logrus.Entry, vol volumes.Volume) error {
+	now := time.Now().UTC()
+
+	opts := backups.CreateOpts{
+		VolumeID:    vol.ID,
+		Name:        fmt.Sprintf("%s-removed-%s", vol.Name, now.Format("20060102-150405")),
+		Description: "Backup taken before removing the volume",
+		Force:       len(vol.Attachments) > 0,
+		Metadata: map[string]string{
+			metadataFieldVolume: vol.Name,
+		},
+	}
+	for _, field := range contentMetadataFields {
+		if v := vol.Metadata[field]; v != "" {
+			opts.Metadata[field] = v
+		}
+	}
+
+	backup, err := backups.Create(d.backupClient(), opts).Extract()
+	if err != nil {
+		return fmt.Errorf("backing up volume %s: %v", vol.Name, err)
+	}
+
+	metadata := map[string]string{
+		metadataFieldRemovedAt:    now.Format(time.RFC3339),
+		metadataFieldRemoveBackup: backup.ID,
+	}
+	if err := d.updateMetadata(vol.ID, metadata); err != nil {
+		return fmt.Errorf("tagging volume %s as removed, its backup %s has been started anyway: %v", vol.Name, opts.Name, err)
+	}
+
+	logger.Infof("Backup %s (%s) of volume %s has been started, the volume will be deleted once it's done.", opts.Name, backup.ID, vol.Name)
+
+	go d.deleteAfterBackup(logger, vol, backup.ID)
+
+	return nil
+}
+
+// resumeRemovals resumes the deletion of the volumes removed with the backup
+// policy, which were still being backed up when the plugin stopped.
+func (d *CinderDriver) resumeRemovals() {
+	logger := logrus.WithField("component", "removals")
+
+	vols, err := d.listRetainedVolumes()
+	if err != nil {
+		logger.Errorf("Could not list retained volumes: %v", err)
+		return
+	}
+
+	for _, vol := range vols {
+		if backupID := vol.Metadata[metadataFieldRemoveBackup]; backupID != "" {
+			logger.Infof("Resuming the removal of volume %s.", vol.Name)
+			go d.deleteAfterBackup(logger.WithField("VolID", vol.ID), vol, backupID)
+		}
+	}
+}
+
+// deleteAfterBackup deletes vol once its backup is available, unless vol has
+// been restored in the meantime. vol is left retained if the backup fails.
+func (d *CinderDriver) deleteAfterBackup(logger *logrus.Entry, vol volumes.Volume, backupID string) {
+	err := waitForEvery(context.Background(), restoreWatchInterval, finalBackupTimeout, func() (bool, error) {
+		b, err := backups.Get(d.backupClient(), backupID).Extract()
+		if err != nil {
+			logger.Warnf("Could not get backup %s of removed volume %s: %v", backupID, vol.Name, err)
+			return false, nil
+		}
+
+		switch b.Status {
+		case "available":
+			return true, nil
+		case "error":
+			return false, fmt.Errorf("backup is in %s status: %s", b.Status, b.FailReason)
+		}
+
+		return false, nil
+	})
+
+	unlock := d.locks.lock(vol.ID)
+	defer unlock()
+
+	fresh, getErr := volumes.Get(d.storageClient, vol.ID).Extract()
+	if _, ok := getErr.(gophercloud.ErrDefault404); ok {
+		// Another server might have deleted it already.
+		return
+	} else if getErr != nil {
+		logger.Errorf("Could not get removed volume %s after its backup: %v", vol.Name, getErr)
+		return
+	} else if !isRemoved(*fresh) || fresh.Metadata[metadataFieldRemoveBackup] != backupID {
+		logger.Infof("Not deleting volume %s, which has been restored while being backed up.", vol.Name)
+		return
+	} else if fresh.Status == "deleting" {
+		return
+	}
+
+	if err != nil {
+		logger.Errorf("Backup %s of removed volume %s failed, the volume is retained instead: %v", backupID, vol.Name, err)
+
+		if err := d.deleteMetadata(vol.ID, metadataFieldRemoveBackup); err != nil {
+			logger.Warnf("Could not clear the pending removal of volume %s: %v", vol.Name, err)
+		}
+		return
+	}
+
+	if err := volumes.Delete(d.storageClient, vol.ID, nil).ExtractErr(); err != nil {
+		logger.Errorf("Could not delete volume %s after its backup: %v", vol.Name, err)
+		return
+	}
+	if err := d.waitForVolumeDeletion(context.Background(), vol.ID, d.timeouts.Delete); err != nil {
+		logger.Errorf("Error waiting for the deletion of volume %s: %v", vol.Name, err)
+		return
+	}
+
+	logger.Infof("Volume %s has been deleted, after being backed up as %s.", vol.Name, backupID)
+}
+
+func (d *CinderDriver) RetainedList(ctx context.Context, logger *logrus.Entry, req RetainedListReq) RetainedListResp {
+	resp := RetainedListResp{
+		Volumes: make([]RetainedVolume, 0),
+	}
+
+	vols, err := d.listRetainedVolumes()
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	for _, vol := range vols {
+		resp.Volumes = append(resp.Volumes, RetainedVolume{
+			ID:        vol.ID,
+			Name:      vol.Name,
+			Size:      vol.Size,
+			RemovedAt: vol.Metadata[metadataFieldRemovedAt],
+		})
+	}
+
+	return resp
+}
+
+// RetainedRestore makes a retained volume visible to Podman again, optionally
+// under a new name.
+func (d *CinderDriver) RetainedRestore(ctx context.Context, logger *logrus.Entry, req RetainedRestoreReq) RetainedRestoreResp {
+	resp := RetainedRestoreResp{}
+
+	vol, err := d.findRetainedVolume(req.Name)
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	logger = logger.WithField("VolID", vol.ID)
+
+	unlock := d.locks.lock(vol.ID)
+	defer unlock()
+
+	name := vol.Name
+	if req.NewName != "" {
+		name = req.NewName
+	}
+
+	if _, _, err := d.lookupVolume(name); err == nil {
+		resp.Err = fmt.Sprintf("volume %s already exists, restore the retained volume under a new name", name)
+		logger.Error(resp.Err)
+
+		return resp
+	} else if err != errVolumeNotFound {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	if name != vol.Name {
+		if _, err := volumes.Update(d.storageClient, vol.ID, volumes.UpdateOpts{Name: &name}).Extract(); err != nil {
+			resp.Err = fmt.Sprintf("could not rename volume %s to %s: %v", vol.Name, name, err)
+			logger.Error(resp.Err)
+
+			return resp
+		}
+	}
+
+	// Volumes still being backed up aren't deleted once they're restored.
+	if vol.Metadata[metadataFieldRemoveBackup] != "" {
+		if err := d.deleteMetadata(vol.ID, metadataFieldRemoveBackup); err != nil {
+			resp.Err = fmt.Sprintf("could not cancel the removal of volume %s: %v", vol.Name, err)
+			logger.Error(resp.Err)
+
+			return resp
+		}
+	}
+
+	if err := d.deleteMetadata(vol.ID, metadataFieldRemovedAt); err != nil {
+		resp.Err = fmt.Sprintf("could not restore volume %s: %v", name, err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	logger.Infof("Retained volume %s has been restored as %s.", vol.Name, name)
+
+	return resp
+}
+
+func (d *CinderDriver) listRetainedVolumes() ([]volumes.Volume, error) {
+	vols, err := d.listAllVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	retained := make([]volumes.Volume, 0)
+	for _, vol := range vols {
+		if isRemoved(vol) {
+			retained = append(retained, vol)
+		}
+	}
+
+	return retained, nil
+}
+
+// findRetainedVolume finds a retained volume by ID, or by name when a single
+// retained volume has that name.
+func (d *CinderDriver) findRetainedVolume(ref string) (volumes.Volume, error) {
+	vols, err := d.listRetainedVolumes()
+	if err != nil {
+		return volumes.Volume{}, err
+	}
+
+	matching := make([]volumes.Volume, 0, 1)
+	for _, vol := range vols {
+		if vol.ID == ref {
+			return vol, nil
+		}
+		if vol.Name == ref {
+			matching = append(matching, vol)
+		}
+	}
+
+	switch len(matching) {
+	case 0:
+		return volumes.Volume{}, fmt.Errorf("retained volume %s not found", ref)
+	case 1:
+		return matching[0], nil
+	}
+
+	return volumes.Volume{}, fmt.Errorf("%d retained volumes are named %s, use the volume ID instead", len(matching), ref)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/sirupsen/logrus"
+)
+
+// The outcome of the last scheduled snapshot of a volume is stored in its
+// metadata, so it's visible whichever host the volume is inspected from.
+const metadataFieldSnapshotLastSuccess = "docker-volume-driver:snapshot-last-success"
+const metadataFieldSnapshotLastFailure = "docker-volume-driver:snapshot-last-failure"
+const metadataFieldSnapshotLastError = "docker-volume-driver:snapshot-last-error"
+
+// metadataFieldScheduled tags the snapshots taken by the scheduler. Only those
+// are pruned.
+const metadataFieldScheduled = "docker-volume-driver:scheduled"
+
+// defaultSnapshotKeep is the number of scheduled snapshots kept for volumes
+// created without the snapshot_keep option.
+const defaultSnapshotKeep = 7
+
+func validateSnapshotSchedule(schedule, keep string) error {
+	if schedule != "" {
+		if _, err := parseCron(schedule); err != nil {
+			return err
+		}
+	}
+
+	if keep != "" {
+		if schedule == "" {
+			return fmt.Errorf("snapshot_keep requires snapshot_schedule to be set")
+		}
+		if n, err := strconv.Atoi(keep); err != nil || n < 1 {
+			return fmt.Errorf("invalid snapshot_keep %s (expected a positive number)", keep)
+		}
+	}
+
+	return nil
+}
+
+func snapshotKeep(vol volumes.Volume) int {
+	if keep, err := strconv.Atoi(vol.Metadata[metadataFieldSnapshotKeep]); err == nil && keep > 0 {
+		return keep
+	}
+
+	return defaultSnapshotKeep
+}
+
+// runScheduler takes the scheduled snapshots of volumes at the start of each
+// minute. It never returns.
+func (d *CinderDriver) runScheduler() {
+	logger := logrus.WithField("component", "scheduler")
+
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(time.Until(next))
+
+		d.runScheduledSnapshots(logger, next)
+	}
+}
+
+func (d *CinderDriver) runScheduledSnapshots(logger *logrus.Entry, t time.Time) {
+	vols, err := d.listVolumes()
+	if err != nil {
+		logger.Errorf("Could not list volumes: %v", err)
+		return
+	}
+
+	for _, vol := range vols {
+		schedule := vol.Metadata[metadataFieldSnapshotSchedule]
+		if schedule == "" || !d.isSnapshotOwner(vol) {
+			continue
+		}
+
+		cron, err := parseCron(schedule)
+		if err != nil {
+			logger.Errorf("Invalid snapshot schedule of volume %s: %v", vol.Name, err)
+			continue
+		}
+		if !cron.matches(t) {
+			continue
+		}
+
+		if _, running := d.snapshotting.LoadOrStore(vol.ID, true); running {
+			logger.Warnf("Skipping the scheduled snapshot of volume %s, the previous one isn't done yet.", vol.Name)
+			continue
+		}
+
+		go func(vol volumes.Volume) {
+			defer d.snapshotting.Delete(vol.ID)
+			d.takeScheduledSnapshot(logger.WithField("VolID", vol.ID), vol, t)
+		}(vol)
+	}
+}
+
+// isSnapshotOwner returns whether this server is in charge of the scheduled
+// snapshots of vol. When vol is attached to several servers, the one with the
+// lowest ID is.
+func (d *CinderDriver) isSnapshotOwner(vol volumes.Volume) bool {
+	owner := ""
+	for _, att := range vol.Attachments {
+		if owner == "" || att.ServerID < owner {
+			owner = att.ServerID
+		}
+	}
+
+	return owner != "" && owner == d.serverID
+}
+
+func (d *CinderDriver) takeScheduledSnapshot(logger *logrus.Entry, vol volumes.Volume, t time.Time) {
+	name := fmt.Sprintf("%s-%s", vol.Name, t.UTC().Format("20060102-1504"))
+	metadata := map[string]string{metadataFieldScheduled: "true"}
+
+	// Scheduled snapshots aren't tied to any request.
+	ctx := context.Background()
+
+	_, err := d.createSnapshot(ctx, logger, vol, name, "Scheduled snapshot", metadata)
+	if err == nil {
+		err = d.pruneScheduledSnapshots(ctx, logger, vol)
+	}
+
+	result := map[string]string{}
+	if err != nil {
+		logger.Errorf("Scheduled snapshot of volume %s failed: %v", vol.Name, err)
+
+		result[metadataFieldSnapshotLastFailure] = time.Now().UTC().Format(time.RFC3339)
+		// Cinder limits metadata values to 255 characters.
+		result[metadataFieldSnapshotLastError] = truncate(err.Error(), 255)
+	} else {
+		result[metadataFieldSnapshotLastSuccess] = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	if err := d.updateMetadata(vol.ID, result); err != nil {
+		logger.Errorf("Could not record the result of the scheduled snapshot of volume %s: %v", vol.Name, err)
+	}
+}
+
+// pruneScheduledSnapshots deletes the oldest scheduled snapshots of vol beyond
+// its retention.
+func (d *CinderDriver) pruneScheduledSnapshots(ctx context.Context, logger *logrus.Entry, vol volumes.Volume) error {
+	snaps, err := d.listSnapshots(vol.Name)
+	if err != nil {
+		return err
+	}
+
+	scheduled := snaps[:0]
+	for _, snap := range snaps {
+		if snap.VolumeID == vol.ID && snap.Metadata[metadataFieldScheduled] == "true" {
+			scheduled = append(scheduled, snap)
+		}
+	}
+
+	sort.Slice(scheduled, func(i, j int) bool { return scheduled[i].CreatedAt.After(scheduled[j].CreatedAt) })
+
+	keep := snapshotKeep(vol)
+	if len(scheduled) <= keep {
+		return nil
+	}
+
+	for _, snap := range scheduled[keep:] {
+		if err := d.removeSnapshot(ctx, logger, snap); err != nil {
+			return fmt.Errorf("pruning snapshot %s: %v", snap.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// snapshotStatus returns the schedule of vol and the outcome of its last
+// scheduled snapshots, as reported in VolumeGetResp.
+func snapshotStatus(vol volumes.Volume) map[string]interface{} {
+	status := map[string]interface{}{
+		"Schedule": vol.Metadata[metadataFieldSnapshotSchedule],
+		"Keep":     snapshotKeep(vol),
+	}
+
+	for key, field := range map[string]string{
+		"LastSuccess": metadataFieldSnapshotLastSuccess,
+		"LastFailure": metadataFieldSnapshotLastFailure,
+		"LastError":   metadataFieldSnapshotLastError,
+	} {
+		if v := vol.Metadata[field]; v != "" {
+			status[key] = v
+		}
+	}
+
+	return status
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	return s[:n]
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumetypes"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	accessExclusive = "exclusive"
+	accessShared    = "shared"
+)
+
+// metadataFieldWriter holds the ID of the server mounting a shared volume in
+// read-write mode. Other servers mount it in read-only mode.
+const metadataFieldWriter = "docker-volume-driver:writer"
+
+// writerLeaseSettle is how long a server waits after taking the writer lease
+// before checking it still holds it, in case another server took it at the
+// same time.
+const writerLeaseSettle = 2 * time.Second
+
+func validateAccess(access string, multiattach bool, fsType, mode string) error {
+	switch access {
+	case "", accessExclusive:
+		if filesystems[fsType].cluster {
+			return fmt.Errorf("filesystem %s requires access=%s", fsType, accessShared)
+		}
+	case accessShared:
+		if !multiattach {
+			return fmt.Errorf("access=%s requires multiattach=true", accessShared)
+		}
+		if mode == modeBlock {
+			return fmt.Errorf("access=%s can't be used in %s mode", accessShared, modeBlock)
+		}
+	default:
+		return fmt.Errorf("invalid access %s (expected either %s or %s)", access, accessExclusive, accessShared)
+	}
+
+	return nil
+}
+
+func isShared(vol volumes.Volume) bool {
+	return vol.Multiattach && vol.Metadata[metadataFieldAccess] == accessShared
+}
+
+// canShareAttachment returns whether vol can stay attached to other servers
+// while being mounted on the current one.
+func canShareAttachment(vol volumes.Volume, readonly bool) bool {
+	return vol.Multiattach && (readonly || isShared(vol))
+}
+
+// multiattachVolumeType returns the volume type used for multiattach volumes:
+// the requested one, provided it supports multiattach, or else the first type
+// supporting it.
+func (d *CinderDriver) multiattachVolumeType(requested string) (string, error) {
+	allPages, err := volumetypes.List(d.storageClient, nil).AllPages()
+	if err != nil {
+		return "", fmt.Errorf("listing volume types: %v", err)
+	}
+
+	types, err := volumetypes.ExtractVolumeTypes(allPages)
+	if err != nil {
+		return "", fmt.Errorf("extracting volume types from api response: %v", err)
+	}
+
+	for _, t := range types {
+		if requested != "" && t.Name != requested && t.ID != requested {
+			continue
+		}
+
+		if isMultiattachType(t) {
+			return t.Name, nil
+		} else if requested != "" {
+			return "", fmt.Errorf("volume type %s doesn't support multiattach", requested)
+		}
+	}
+
+	if requested != "" {
+		return "", fmt.Errorf("volume type %s doesn't exist", requested)
+	}
+
+	return "", fmt.Errorf("no volume type supports multiattach")
+}
+
+func isMultiattachType(t volumetypes.VolumeType) bool {
+	v := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(t.ExtraSpecs["multiattach"], "<is>")))
+	return v == "true"
+}
+
+// sharedReadonly returns whether the current server has to mount the shared
+// volume vol in read-only mode, taking the writer lease when it's free.
+// Cluster filesystems are mounted in read-write mode everywhere.
+func (d *CinderDriver) sharedReadonly(logger *logrus.Entry, vol volumes.Volume) (bool, error) {
+	fsType, err := getFSMetadata(vol)
+	if err != nil {
+		return false, err
+	}
+	if filesystems[fsType].cluster {
+		return false, nil
+	}
+
+	// The filesystem might already be mounted for another container, in
+	// which case it's kept in its current mode.
+	mountpoint := path.Join(propagatedMount, vol.ID)
+	if mounted, err := isMounted(mountpoint); err != nil {
+		return false, fmt.Errorf("checking if volume %s is already mounted: %v", vol.Name, err)
+	} else if mounted {
+		return isMountedReadonly(mountpoint)
+	}
+
+	writer, err := d.acquireWriterLease(vol)
+	if err != nil {
+		return false, fmt.Errorf("taking the writer lease of volume %s: %v", vol.Name, err)
+	}
+	if writer != d.serverID {
+		logger.Infof("Volume %s is mounted in read-write mode by server %s, mounting it in read-only mode.", vol.Name, writer)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// acquireWriterLease makes the current server the writer of vol, unless
+// another server still holds the lease, and returns the ID of the writer. A
+// lease is released when its holder unmounts the volume, and considered stale
+// once the volume isn't attached to its holder anymore. As Cinder metadata
+// can't be updated atomically, two servers taking the lease at the same time
+// are told apart by reading it back.
+func (d *CinderDriver) acquireWriterLease(vol volumes.Volume) (string, error) {
+	fresh, err := volumes.Get(d.storageClient, vol.ID).Extract()
+	if err != nil {
+		return "", err
+	}
+
+	holder := fresh.Metadata[metadataFieldWriter]
+	if holder == d.serverID || (holder != "" && isAttachedTo(*fresh, holder)) {
+		return holder, nil
+	}
+
+	if err := d.updateMetadata(vol.ID, map[string]string{metadataFieldWriter: d.serverID}); err != nil {
+		return "", err
+	}
+
+	time.Sleep(writerLeaseSettle)
+
+	fresh, err = volumes.Get(d.storageClient, vol.ID).Extract()
+	if err != nil {
+		return "", err
+	}
+
+	return fresh.Metadata[metadataFieldWriter], nil
+}
+
+// releaseWriterLease releases the writer lease of vol, if the current server
+// holds it.
+func (d *CinderDriver) releaseWriterLease(vol volumes.Volume) error {
+	if vol.Metadata[metadataFieldWriter] != d.serverID {
+		return nil
+	}
+
+	return d.deleteMetadata(vol.ID, metadataFieldWriter)
+}
+
+func isMountedReadonly(mountpoint string) (bool, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(mountpoint, &st); err != nil {
+		return false, fmt.Errorf("statfs %s: %v", mountpoint, err)
+	}
+
+	return st.Flags&unix.ST_RDONLY != 0, nil
+}
+
+// isAttachedElsewhere returns whether vol is attached to other servers than
+// serverID.
+func isAttachedElsewhere(vol volumes.Volume, serverID string) bool {
+	for _, att := range vol.Attachments {
+		if att.ServerID != serverID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isAttachedTo(vol volumes.Volume, serverID string) bool {
+	for _, att := range vol.Attachments {
+		if att.ServerID == serverID {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/snapshots"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/sirupsen/logrus"
+)
+
+// metadataFieldVolume tags snapshots with the name of the volume they were
+// taken from.
+const metadataFieldVolume = "docker-volume-driver:volume"
+
+// contentMetadataFields are the metadata fields describing the content of a
+// volume. They're copied to snapshots, so volumes created from them inherit
+// these fields.
+var contentMetadataFields = []string{
+	metadataFieldFS,
+	metadataFieldPartition,
+	metadataFieldEncrypted,
+	metadataFieldKeyRef,
+	metadataFieldMode,
+}
+
+func (d *CinderDriver) SnapshotCreate(ctx context.Context, logger *logrus.Entry, req SnapshotCreateReq) SnapshotCreateResp {
+	resp := SnapshotCreateResp{}
+
+	vol, sub, err := d.lookupVolume(req.Volume)
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	} else if sub != nil {
+		resp.Err = fmt.Sprintf("volume %s is a sub-volume of %s, snapshot its parent instead", req.Volume, vol.Name)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	logger = logger.WithField("VolID", vol.ID)
+
+	name := req.Name
+	if name == "" {
+		name = fmt.Sprintf("%s-%s", vol.Name, time.Now().UTC().Format("20060102-150405"))
+	}
+
+	snap, err := d.createSnapshot(ctx, logger, vol, name, req.Description, nil)
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	resp.Snapshot = toSnapshot(snap)
+	return resp
+}
+
+// createSnapshot takes a snapshot of vol, tagged with its name, and waits for
+// it to be available.
+func (d *CinderDriver) createSnapshot(ctx context.Context, logger *logrus.Entry, vol volumes.Volume, name, description string, metadata map[string]string) (snapshots.Snapshot, error) {
+	opts := snapshots.CreateOpts{
+		VolumeID:    vol.ID,
+		Name:        name,
+		Description: description,
+		Metadata: map[string]string{
+			metadataFieldVolume: vol.Name,
+		},
+	}
+	for _, field := range contentMetadataFields {
+		if v := vol.Metadata[field]; v != "" {
+			opts.Metadata[field] = v
+		}
+	}
+	for k, v := range metadata {
+		opts.Metadata[k] = v
+	}
+
+	// Cinder refuses to snapshot attached volumes unless forced.
+	if len(vol.Attachments) > 0 {
+		opts.Force = true
+
+		if err := d.flushFilesystem(logger, vol); err != nil {
+			return snapshots.Snapshot{}, err
+		}
+	}
+
+	snap, err := snapshots.Create(d.storageClient, opts).Extract()
+	if err != nil {
+		return snapshots.Snapshot{}, fmt.Errorf("could not create snapshot %s of volume %s: %v", name, vol.Name, err)
+	}
+
+	if err := d.waitForSnapshotStatus(ctx, snap.ID, "available", d.timeouts.Snapshot); err != nil {
+		return snapshots.Snapshot{}, fmt.Errorf("error waiting for snapshot %s to be created: %v", name, err)
+	}
+
+	logger.Infof("Snapshot %s (%s) of volume %s has been created.", name, snap.ID, vol.Name)
+	snap.Status = "available"
+
+	return *snap, nil
+}
+
+func (d *CinderDriver) SnapshotList(ctx context.Context, logger *logrus.Entry, req SnapshotListReq) SnapshotListResp {
+	resp := SnapshotListResp{
+		Snapshots: make([]Snapshot, 0),
+	}
+
+	snaps, err := d.listSnapshots(req.Volume)
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	for _, snap := range snaps {
+		resp.Snapshots = append(resp.Snapshots, toSnapshot(snap))
+	}
+
+	return resp
+}
+
+func (d *CinderDriver) SnapshotGet(ctx context.Context, logger *logrus.Entry, req SnapshotGetReq) SnapshotGetResp {
+	resp := SnapshotGetResp{}
+
+	snap, err := d.findSnapshot(req.Name)
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	resp.Snapshot = toSnapshot(snap)
+	return resp
+}
+
+func (d *CinderDriver) SnapshotRemove(ctx context.Context, logger *logrus.Entry, req SnapshotRemoveReq) SnapshotRemoveResp {
+	resp := SnapshotRemoveResp{}
+
+	snap, err := d.findSnapshot(req.Name)
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	if err := d.removeSnapshot(ctx, logger, snap); err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	return resp
+}
+
+func (d *CinderDriver) removeSnapshot(ctx context.Context, logger *logrus.Entry, snap snapshots.Snapshot) error {
+	if err := snapshots.Delete(d.storageClient, snap.ID).ExtractErr(); err != nil {
+		return fmt.Errorf("failed to delete snapshot %s: %v", snap.Name, err)
+	}
+
+	url := d.storageClient.ServiceURL("snapshots", snap.ID)
+	err := waitFor(ctx, d.timeouts.Snapshot, func() (bool, error) {
+		if _, err := d.storageClient.Get(url, nil, nil); err != nil {
+			if _, ok := err.(gophercloud.ErrDefault404); ok {
+				return true, nil
+			}
+
+			return false, err
+		}
+
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("error waiting for snapshot deletion to complete: %v", err)
+	}
+
+	logger.Infof("Snapshot %s (%s) has been deleted.", snap.Name, snap.ID)
+
+	return nil
+}
+
+// listSnapshots returns the snapshots taken through the plugin, optionally
+// only those of the given volume.
+func (d *CinderDriver) listSnapshots(volume string) ([]snapshots.Snapshot, error) {
+	snaps := make([]snapshots.Snapshot, 0)
+
+	allPages, err := snapshots.List(d.storageClient, nil).AllPages()
+	if err != nil {
+		return snaps, fmt.Errorf("listing openstack snapshots: %v", err)
+	}
+
+	list, err := snapshots.ExtractSnapshots(allPages)
+	if err != nil {
+		return snaps, fmt.Errorf("extracting openstack snapshots from api response: %v", err)
+	}
+
+	for _, snap := range list {
+		v, ok := snap.Metadata[metadataFieldVolume]
+		if !ok || (volume != "" && v != volume) {
+			continue
+		}
+
+		snaps = append(snaps, snap)
+	}
+
+	return snaps, nil
+}
+
+// findSnapshot finds a snapshot by name among the snapshots taken through the
+// plugin, or by ID.
+func (d *CinderDriver) findSnapshot(ref string) (snapshots.Snapshot, error) {
+	snaps, err := d.listSnapshots("")
+	if err != nil {
+		return snapshots.Snapshot{}, err
+	}
+
+	matching := make([]snapshots.Snapshot, 0, 1)
+	for _, snap := range snaps {
+		if snap.ID == ref {
+			return snap, nil
+		}
+		if snap.Name == ref {
+			matching = append(matching, snap)
+		}
+	}
+
+	switch len(matching) {
+	case 1:
+		return matching[0], nil
+	case 0:
+		snap, err := snapshots.Get(d.storageClient, ref).Extract()
+		if _, ok := err.(gophercloud.ErrDefault404); ok {
+			return snapshots.Snapshot{}, fmt.Errorf("snapshot %s not found", ref)
+		} else if err != nil {
+			return snapshots.Snapshot{}, fmt.Errorf("could not get snapshot %s: %v", ref, err)
+		}
+
+		return *snap, nil
+	}
+
+	return snapshots.Snapshot{}, fmt.Errorf("%d snapshots are named %s, use the snapshot ID instead", len(matching), ref)
+}
+
+func (d *CinderDriver) waitForSnapshotStatus(ctx context.Context, snapID, status string, timeout time.Duration) error {
+	return waitFor(ctx, timeout, func() (bool, error) {
+		snap, err := snapshots.Get(d.storageClient, snapID).Extract()
+		if err != nil {
+			return false, err
+		}
+
+		if snap.Status == "error" {
+			return false, fmt.Errorf("snapshot is in %s status", snap.Status)
+		}
+
+		return snap.Status == status, nil
+	})
+}
+
+func toSnapshot(snap snapshots.Snapshot) Snapshot {
+	return Snapshot{
+		ID:          snap.ID,
+		Name:        snap.Name,
+		Volume:      snap.Metadata[metadataFieldVolume],
+		VolumeID:    snap.VolumeID,
+		Status:      snap.Status,
+		Size:        snap.Size,
+		Description: snap.Description,
+		CreatedAt:   snap.CreatedAt.String(),
+		Metadata:    snap.Metadata,
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const defaultStateDir = "/var/lib/cinder-volume-plugin"
+
+// volumeState holds what this host knows about a volume but can't be stored in
+// Cinder, e.g. because it's specific to this host.
+type volumeState struct {
+	Fsck *fsckResult `json:",omitempty"`
+	// InUse is true while the volume itself is mounted, as opposed to its
+	// filesystem being mounted only for its sub-volumes.
+	InUse bool `json:",omitempty"`
+	// LastUnmount is when the volume or one of its sub-volumes was last
+	// unmounted on this host.
+	LastUnmount time.Time `json:",omitzero"`
+	// Restore is the restore of a backup into the volume started from this
+	// host, until the volume has been fixed up after it.
+	Restore *pendingRestore `json:",omitempty"`
+}
+
+// stateStore keeps the volumeState of each volume, indexed by volume ID, and
+// persists them in a JSON file to survive plugin restarts.
+type stateStore struct {
+	mu      sync.Mutex
+	path    string
+	volumes map[string]*volumeState
+}
+
+func newStateStore(dir string) (*stateStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating state dir %s: %v", dir, err)
+	}
+
+	s := &stateStore{
+		path:    path.Join(dir, "state.json"),
+		volumes: map[string]*volumeState{},
+	}
+
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading state file: %v", err)
+	}
+
+	if err := json.Unmarshal(content, &s.volumes); err != nil {
+		return nil, fmt.Errorf("parsing state file %s: %v", s.path, err)
+	}
+
+	return s, nil
+}
+
+// get returns a copy of the state of volID.
+func (s *stateStore) get(volID string) volumeState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if st, ok := s.volumes[volID]; ok {
+		return *st
+	}
+
+	return volumeState{}
+}
+
+// all returns a copy of the state of every volume, indexed by volume ID.
+func (s *stateStore) all() map[string]volumeState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all := make(map[string]volumeState, len(s.volumes))
+	for volID, st := range s.volumes {
+		all[volID] = *st
+	}
+
+	return all
+}
+
+// update applies fn to the state of volID and persists the result.
+func (s *stateStore) update(volID string, fn func(st *volumeState)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.volumes[volID]
+	if !ok {
+		st = &volumeState{}
+		s.volumes[volID] = st
+	}
+	fn(st)
+
+	return s.save()
+}
+
+// remove forgets about volID, e.g. once it has been deleted.
+func (s *stateStore) remove(volID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.volumes[volID]; !ok {
+		return nil
+	}
+	delete(s.volumes, volID)
+
+	return s.save()
+}
+
+// save writes the state file. The caller must hold s.mu.
+func (s *stateStore) save() error {
+	content, err := json.Marshal(s.volumes)
+	if err != nil {
+		return fmt.Errorf("encoding state: %v", err)
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return fmt.Errorf("writing state file: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("writing state file: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/extendedstatus"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	stealNever        = "never"
+	stealIfServerDown = "if-server-down"
+	stealAlways       = "always"
+)
+
+func validateStealPolicy(policy string) error {
+	switch policy {
+	case stealNever, stealIfServerDown, stealAlways:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported steal policy %s (supported: %s, %s, %s)", policy, stealNever, stealIfServerDown, stealAlways)
+}
+
+// downServerStatuses are the Nova statuses of servers which can't be writing
+// to their volumes.
+var downServerStatuses = map[string]bool{
+	"SHUTOFF":           true,
+	"SUSPENDED":         true,
+	"SHELVED":           true,
+	"SHELVED_OFFLOADED": true,
+	"ERROR":             true,
+	"SOFT_DELETED":      true,
+	"DELETED":           true,
+}
+
+// checkSteal makes sure vol can be detached from the other servers it's
+// attached to, according to the steal policy, before attaching it to the
+// current server.
+func (d *CinderDriver) checkSteal(logger *logrus.Entry, vol volumes.Volume) error {
+	for _, att := range vol.Attachments {
+		if att.ServerID == d.serverID {
+			continue
+		}
+
+		switch d.stealPolicy {
+		case stealNever:
+			return fmt.Errorf("volume %s is in use by server %s", vol.Name, att.ServerID)
+		case stealAlways:
+			logger.Warnf("Volume %s is attached to server %s, detaching it.", vol.Name, att.ServerID)
+			continue
+		}
+
+		down, state, err := d.serverDown(att.ServerID)
+		if err != nil {
+			return fmt.Errorf("checking the state of server %s, which volume %s is attached to: %v", att.ServerID, vol.Name, err)
+		} else if !down {
+			return fmt.Errorf("volume %s is in use by server %s (%s)", vol.Name, att.ServerID, state)
+		}
+
+		logger.Warnf("Volume %s is attached to server %s, which is down (%s), detaching it.", vol.Name, att.ServerID, state)
+	}
+
+	return nil
+}
+
+// serverDown returns whether the server serverID is down, along with its state.
+// Servers that don't exist anymore are down.
+func (d *CinderDriver) serverDown(serverID string) (bool, string, error) {
+	var server struct {
+		Status     string                    `json:"status"`
+		PowerState extendedstatus.PowerState `json:"OS-EXT-STS:power_state"`
+	}
+
+	err := servers.Get(d.computeClient, serverID).ExtractInto(&server)
+	if _, ok := err.(gophercloud.ErrDefault404); ok {
+		return true, "deleted", nil
+	} else if err != nil {
+		return false, "", err
+	}
+
+	state := fmt.Sprintf("status %s, power state %s", server.Status, server.PowerState)
+
+	// The status of servers lags behind their power state when they crash or
+	// are shut down from inside.
+	if downServerStatuses[server.Status] || server.PowerState == extendedstatus.SHUTDOWN || server.PowerState == extendedstatus.CRASHED {
+		return true, state, nil
+	}
+
+	return false, state, nil
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/opencontainers/selinux/go-selinux"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// metadataPrefixSubVolume prefixes the metadata keys of a parent volume
+// describing its sub-volumes. It's followed by the name of the sub-volume.
+const metadataPrefixSubVolume = "docker-volume-driver:child:"
+
+// subVolumesDir is the directory, relative to the root of the filesystem of the
+// parent volume, where sub-volumes are stored. It's a sibling of the datadir,
+// so sub-volumes aren't visible from containers using the parent volume.
+const subVolumesDir = "volumes"
+
+// orphanedSubVolumesDir is the directory, relative to the root of the
+// filesystem of the parent volume, where the directories of unknown
+// sub-volumes are moved to.
+const orphanedSubVolumesDir = "volumes.orphaned"
+
+// subVolumesMount is the directory under which sub-volumes are bind-mounted.
+var subVolumesMount = path.Join(propagatedMount, "subvolumes")
+
+// subVolume is a directory inside the filesystem of a parent Cinder volume,
+// exposed as a volume of its own.
+type subVolume struct {
+	Name string `json:"-"`
+	UID  string `json:"uid,omitempty"`
+	GID  string `json:"gid,omitempty"`
+	Mode string `json:"mode,omitempty"`
+	// Quota is the size limit of the sub-volume, enforced with the project
+	// quota Project.
+	Quota   string `json:"quota,omitempty"`
+	Project int    `json:"project,omitempty"`
+}
+
+// subVolumes returns the sub-volumes of vol, sorted by name.
+func subVolumes(vol volumes.Volume) ([]subVolume, error) {
+	subs := make([]subVolume, 0)
+
+	for k, v := range vol.Metadata {
+		if !strings.HasPrefix(k, metadataPrefixSubVolume) {
+			continue
+		}
+
+		sub := subVolume{Name: strings.TrimPrefix(k, metadataPrefixSubVolume)}
+		if err := json.Unmarshal([]byte(v), &sub); err != nil {
+			return nil, fmt.Errorf("reading %s: %v", k, err)
+		}
+
+		subs = append(subs, sub)
+	}
+
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Name < subs[j].Name })
+
+	return subs, nil
+}
+
+// lookupVolume finds the volume named name. When it's a sub-volume, its parent
+// is returned along with it.
+func (d *CinderDriver) lookupVolume(name string) (volumes.Volume, *subVolume, error) {
+	vols, err := d.listVolumes()
+	if err != nil {
+		return volumes.Volume{}, nil, fmt.Errorf("failed to find volume %s: %v", name, err)
+	}
+
+	for _, vol := range vols {
+		if vol.Name == name {
+			return vol, nil, nil
+		}
+	}
+
+	for _, vol := range vols {
+		subs, err := subVolumes(vol)
+		if err != nil {
+			return volumes.Volume{}, nil, fmt.Errorf("failed to find volume %s: %v", name, err)
+		}
+
+		for _, sub := range subs {
+			if sub.Name == name {
+				return vol, &sub, nil
+			}
+		}
+	}
+
+	return volumes.Volume{}, nil, errVolumeNotFound
+}
+
+// reloadVolume gets vol and its sub-volume sub again. It's called once the
+// lock of vol is held, as its sub-volumes might have changed in the meantime.
+func (d *CinderDriver) reloadVolume(vol volumes.Volume, sub *subVolume) (volumes.Volume, *subVolume, error) {
+	fresh, err := volumes.Get(d.storageClient, vol.ID).Extract()
+	if err != nil {
+		return volumes.Volume{}, nil, fmt.Errorf("failed to get volume %s: %v", vol.Name, err)
+	}
+	if sub == nil {
+		return *fresh, nil, nil
+	}
+
+	subs, err := subVolumes(*fresh)
+	if err != nil {
+		return volumes.Volume{}, nil, err
+	}
+	for _, s := range subs {
+		if s.Name == sub.Name {
+			return *fresh, &s, nil
+		}
+	}
+
+	return volumes.Volume{}, nil, errVolumeNotFound
+}
+
+func (d *CinderDriver) createSubVolume(logger *logrus.Entry, req VolumeCreateReq) error {
+	// Sub-volumes only have their own permissions, everything else comes from
+	// their parent.
+	for opt, value := range map[string]string{
+		"size":              req.Opts.Size,
+		"availability_zone": req.Opts.AvailabilityZone,
+		"source_snapshot":   req.Opts.SnapshotID,
+		"source_backup":     req.Opts.BackupID,
+		"source_volume":     req.Opts.SourceVolume,
+		"source_image":      req.Opts.SourceImage,
+		"volume_type":       req.Opts.VolumeType,
+		"fs":                req.Opts.FS,
+		"mkfs_opts":         req.Opts.MkfsOpts,
+		"mount_opts":        req.Opts.MountOpts,
+		"fsck":              req.Opts.Fsck,
+		"encrypted":         req.Opts.Encrypted,
+		"partition":         req.Opts.Partition,
+		"readonly":          req.Opts.Readonly,
+		"snapshot_schedule": req.Opts.SnapshotSchedule,
+		"snapshot_keep":     req.Opts.SnapshotKeep,
+		"remove_policy":     req.Opts.RemovePolicy,
+		"multiattach":       req.Opts.Multiattach,
+		"access":            req.Opts.Access,
+	} {
+		if value != "" {
+			return fmt.Errorf("option %s can't be used along with parent", opt)
+		}
+	}
+	if len(req.Opts.Labels) > 0 {
+		return fmt.Errorf("%s options can't be used along with parent", labelOptPrefix)
+	}
+	if req.Opts.Mode == modeBlock {
+		return fmt.Errorf("sub-volumes can't be in %s mode", modeBlock)
+	}
+
+	if _, _, err := d.lookupVolume(req.Name); err == nil {
+		return fmt.Errorf("volume %s already exists", req.Name)
+	} else if err != errVolumeNotFound {
+		return err
+	}
+
+	parent, sub, err := d.lookupVolume(req.Opts.Parent)
+	if err != nil {
+		return fmt.Errorf("parent volume %s: %v", req.Opts.Parent, err)
+	}
+	if sub != nil {
+		return fmt.Errorf("parent volume %s is a sub-volume itself", req.Opts.Parent)
+	}
+	if isBlockMode(parent) {
+		return fmt.Errorf("parent volume %s has no filesystem", req.Opts.Parent)
+	}
+	if isShared(parent) {
+		return fmt.Errorf("parent volume %s is shared", req.Opts.Parent)
+	}
+
+	unlock := d.locks.lock(parent.ID)
+	defer unlock()
+
+	if parent, _, err = d.reloadVolume(parent, nil); err != nil {
+		return err
+	}
+
+	sub = &subVolume{
+		Name: req.Name,
+		UID:  req.Opts.Uid,
+		GID:  req.Opts.Gid,
+		Mode: req.Opts.Mode,
+	}
+	if _, _, _, err := parsePerms(sub.UID, sub.GID, sub.Mode); err != nil {
+		return err
+	}
+
+	root := path.Join(propagatedMount, parent.ID)
+
+	mounted, err := isMounted(root)
+	if err != nil {
+		return err
+	}
+
+	if req.Opts.Quota != "" {
+		fsType, err := getFSMetadata(parent)
+		if err != nil {
+			return err
+		}
+		if err := validateQuota(fsType, req.Opts.Quota); err != nil {
+			return err
+		}
+
+		// Project quotas can only be turned on when mounting the filesystem.
+		if mounted {
+			if ok, err := hasProjectQuota(root); err != nil {
+				return err
+			} else if !ok {
+				return fmt.Errorf("project quotas aren't enabled on parent volume %s, it has to be unmounted first", parent.Name)
+			}
+		}
+
+		subs, err := subVolumes(parent)
+		if err != nil {
+			return err
+		}
+
+		sub.Quota = req.Opts.Quota
+		sub.Project = datadirProject + 1
+		for _, s := range subs {
+			if s.Project >= sub.Project {
+				sub.Project = s.Project + 1
+			}
+		}
+	}
+
+	record, err := json.Marshal(sub)
+	if err != nil {
+		return fmt.Errorf("encoding sub-volume %s: %v", req.Name, err)
+	}
+
+	if err := d.updateMetadata(parent.ID, map[string]string{metadataPrefixSubVolume + req.Name: string(record)}); err != nil {
+		return fmt.Errorf("registering sub-volume %s in volume %s: %v", req.Name, parent.Name, err)
+	}
+
+	// When the parent isn't mounted on this server, the directory of the
+	// sub-volume is created on its first mount.
+	if mounted {
+		if err := createSubVolumeDir(logger, root, *sub); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createSubVolumeDir creates the directory of sub in the filesystem of its
+// parent mounted on root, if it doesn't exist yet.
+func createSubVolumeDir(logger *logrus.Entry, root string, sub subVolume) error {
+	dir := path.Join(root, subVolumesDir, sub.Name)
+
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("stat %s failed: %v", dir, err)
+	}
+
+	uid, gid, mode, err := parsePerms(sub.UID, sub.GID, sub.Mode)
+	if err != nil {
+		return err
+	}
+
+	logger.Debugf("Create the directory of sub-volume %s with filemode and perms: %#o %d:%d.", sub.Name, mode, uid, gid)
+
+	if err := os.MkdirAll(path.Dir(dir), 0700); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, os.FileMode(mode)); err != nil {
+		return err
+	}
+	if err := os.Chown(dir, uid, gid); err != nil {
+		return err
+	}
+
+	if selinux.GetEnabled() {
+		if err := selinux.SetFileLabel(dir, containerFileLabel); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// quarantineSubVolumeDirs moves away the directories of unknown sub-volumes,
+// so they can't be picked up by new sub-volumes of the same name. They're
+// either sub-volumes removed while their parent wasn't mounted on this server,
+// or sub-volumes of another volume, copied by cloning or restoring it, which
+// aren't registered on this one. As such, they're kept until removed by hand.
+func quarantineSubVolumeDirs(logger *logrus.Entry, root string, subs []subVolume) error {
+	entries, err := os.ReadDir(path.Join(root, subVolumesDir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool, len(subs))
+	for _, sub := range subs {
+		known[sub.Name] = true
+	}
+
+	now := time.Now().UTC().Format("20060102-150405")
+	for _, entry := range entries {
+		if known[entry.Name()] {
+			continue
+		}
+
+		if err := os.MkdirAll(path.Join(root, orphanedSubVolumesDir), 0700); err != nil {
+			return err
+		}
+
+		dest := path.Join(orphanedSubVolumesDir, fmt.Sprintf("%s-%s", entry.Name(), now))
+		logger.Warnf("Sub-volume %s isn't registered anymore, moving its directory to %s.", entry.Name(), dest)
+
+		if err := os.Rename(path.Join(root, subVolumesDir, entry.Name()), path.Join(root, dest)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mountSubVolume mounts the filesystem of parent if needed, and bind-mounts
+// the directory of sub.
+func (d *CinderDriver) mountSubVolume(ctx context.Context, logger *logrus.Entry, parent volumes.Volume, sub subVolume) (string, error) {
+	logger = logger.WithField("Parent", parent.Name)
+
+	if _, err := d.mountVolume(ctx, logger, parent); err != nil {
+		return "", err
+	}
+
+	root := path.Join(propagatedMount, parent.ID)
+
+	subs, err := subVolumes(parent)
+	if err != nil {
+		return "", err
+	}
+	if err := quarantineSubVolumeDirs(logger, root, subs); err != nil {
+		logger.Warnf("Could not move the directories of unknown sub-volumes away: %v", err)
+	}
+
+	if err := createSubVolumeDir(logger, root, sub); err != nil {
+		return "", err
+	}
+
+	if err := d.applySubVolumeQuota(logger, parent, sub); err != nil {
+		return "", err
+	}
+
+	mountpoint := path.Join(subVolumesMount, sub.Name)
+	if mounted, err := isMounted(mountpoint); err != nil {
+		return "", fmt.Errorf("checking if sub-volume is already mounted: %v", err)
+	} else if mounted {
+		return mountpoint, nil
+	}
+
+	if err := os.MkdirAll(mountpoint, 0750); err != nil {
+		return "", fmt.Errorf("failed to create mountpoint directory %s: %v", mountpoint, err)
+	}
+
+	if err := unix.Mount(path.Join(root, subVolumesDir, sub.Name), mountpoint, "", unix.MS_BIND, ""); err != nil {
+		return "", fmt.Errorf("bind-mounting sub-volume %s: %v", sub.Name, err)
+	}
+
+	return mountpoint, nil
+}
+
+// unmountSubVolume unmounts sub, and the filesystem of its parent if it isn't
+// used anymore.
+func (d *CinderDriver) unmountSubVolume(logger *logrus.Entry, parent volumes.Volume, sub subVolume) error {
+	mountpoint := path.Join(subVolumesMount, sub.Name)
+
+	if mounted, err := isMounted(mountpoint); err != nil {
+		return fmt.Errorf("checking if volume %s is already mounted: %v", sub.Name, err)
+	} else if !mounted {
+		return fmt.Errorf("volume %s is not mounted", sub.Name)
+	}
+
+	if err := unix.Unmount(mountpoint, 0); err != nil {
+		return fmt.Errorf("unmounting volume %s: %v", sub.Name, err)
+	}
+
+	if err := os.Remove(mountpoint); err != nil {
+		logger.Errorf("failed to remove mountpoint directory %s after unmount: %v", mountpoint, err)
+	}
+
+	return d.releaseFilesystem(logger, parent)
+}
+
+func (d *CinderDriver) removeSubVolume(logger *logrus.Entry, parent volumes.Volume, sub subVolume) error {
+	if mounted, err := isMounted(path.Join(subVolumesMount, sub.Name)); err != nil {
+		return fmt.Errorf("checking if volume is still mounted: %v", err)
+	} else if mounted {
+		return fmt.Errorf("volume is still mounted")
+	}
+
+	if err := d.deleteMetadata(parent.ID, metadataPrefixSubVolume+sub.Name); err != nil {
+		return fmt.Errorf("unregistering sub-volume %s from volume %s: %v", sub.Name, parent.Name, err)
+	}
+
+	// When the parent isn't mounted on this server, the directory is moved to
+	// orphanedSubVolumesDir on its next mount.
+	root := path.Join(propagatedMount, parent.ID)
+	if mounted, err := isMounted(root); err != nil {
+		return err
+	} else if mounted {
+		if err := os.RemoveAll(path.Join(root, subVolumesDir, sub.Name)); err != nil {
+			return fmt.Errorf("removing the directory of sub-volume %s: %v", sub.Name, err)
+		}
+
+		if sub.Quota != "" {
+			if fsType, err := getFSMetadata(parent); err != nil {
+				logger.Warnf("Could not lift the quota of project %d: %v", sub.Project, err)
+			} else if err := setProjectQuota(root, "", fsType, sub.Project, 0); err != nil {
+				logger.Warnf("Could not lift the quota of project %d: %v", sub.Project, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// mountedSubVolumes returns the number of sub-volumes of vol currently
+// mounted on this server.
+func mountedSubVolumes(vol volumes.Volume) (int, error) {
+	subs, err := subVolumes(vol)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, sub := range subs {
+		if mounted, err := isMounted(path.Join(subVolumesMount, sub.Name)); err != nil {
+			return 0, err
+		} else if mounted {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func subVolumeMountpoint(sub subVolume) (string, error) {
+	mountpoint := path.Join(subVolumesMount, sub.Name)
+	if ok, err := isMounted(mountpoint); err != nil || !ok {
+		return "", err
+	}
+
+	return mountpoint, nil
+}
+
+// applySubVolumeQuota enforces the quota of sub, if any, on its directory.
+func (d *CinderDriver) applySubVolumeQuota(logger *logrus.Entry, parent volumes.Volume, sub subVolume) error {
+	if sub.Quota == "" {
+		return nil
+	}
+
+	if readonly, err := d.isReadonly(parent); err != nil || readonly {
+		return err
+	}
+
+	fsType, err := getFSMetadata(parent)
+	if err != nil {
+		return err
+	}
+
+	limit, err := parseQuota(sub.Quota)
+	if err != nil {
+		return fmt.Errorf("reading the quota of sub-volume %s: %v", sub.Name, err)
+	}
+
+	logger.Debugf("Limit sub-volume %s to %d bytes.", sub.Name, limit)
+
+	root := path.Join(propagatedMount, parent.ID)
+	if err := setProjectQuota(root, path.Join(root, subVolumesDir, sub.Name), fsType, sub.Project, limit); err != nil {
+		return fmt.Errorf("failed to set the quota of sub-volume %s: %v", sub.Name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/volumetransfers"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/sirupsen/logrus"
+)
+
+// metadataFieldTransferName is the name of a volume being transferred, without
+// the VOLUME_PREFIX of the project it comes from. The project accepting the
+// transfer names the volume after it, with its own prefix.
+const metadataFieldTransferName = "docker-volume-driver:transfer-name"
+
+func (d *CinderDriver) TransferCreate(ctx context.Context, logger *logrus.Entry, req TransferCreateReq) TransferCreateResp {
+	resp := TransferCreateResp{}
+
+	vol, sub, err := d.lookupVolume(req.Volume)
+	if err != nil {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	} else if sub != nil {
+		resp.Err = fmt.Sprintf("volume %s is a sub-volume of %s, transfer its parent instead", req.Volume, vol.Name)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	logger = logger.WithField("VolID", vol.ID)
+
+	unlock := d.locks.lock(vol.ID)
+	defer unlock()
+
+	if mountpoint, err := d.userMountpoint(vol); err != nil {
+		resp.Err = fmt.Sprintf("checking if volume is still mounted: %v", err)
+		logger.Error(resp.Err)
+
+		return resp
+	} else if mountpoint != "" {
+		resp.Err = fmt.Sprintf("volume %s is still mounted", req.Volume)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+	if count, err := mountedSubVolumes(vol); err != nil {
+		resp.Err = fmt.Sprintf("checking if sub-volumes are still mounted: %v", err)
+		logger.Error(resp.Err)
+
+		return resp
+	} else if count > 0 {
+		resp.Err = fmt.Sprintf("%d sub-volumes of volume %s are still mounted", count, req.Volume)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	// Unmount() leaves volumes attached, but Cinder only transfers available
+	// volumes.
+	if err := closeEncrypted(vol); err != nil {
+		resp.Err = fmt.Sprintf("closing encrypted volume: %v", err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+	if len(vol.Attachments) > 0 {
+		if err := d.detachVolume(ctx, logger, vol, false, true); err != nil {
+			resp.Err = fmt.Sprintf("detaching volume from current server: %v", err)
+			logger.Error(resp.Err)
+
+			return resp
+		}
+	}
+
+	if err := d.updateMetadata(vol.ID, map[string]string{
+		metadataFieldTransferName: strings.TrimPrefix(vol.Name, d.volumePrefix),
+	}); err != nil {
+		resp.Err = fmt.Sprintf("could not tag volume %s for the transfer: %v", req.Volume, err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	transfer, err := volumetransfers.Create(d.storageClient, volumetransfers.CreateOpts{
+		VolumeID: vol.ID,
+		Name:     vol.Name,
+	}).Extract()
+	if err != nil {
+		resp.Err = fmt.Sprintf("could not transfer volume %s: %v", req.Volume, err)
+		logger.Error(resp.Err)
+
+		if err := d.deleteMetadata(vol.ID, metadataFieldTransferName); err != nil {
+			logger.Warnf("Could not delete the metadata %s of volume %s: %v", metadataFieldTransferName, req.Volume, err)
+		}
+
+		return resp
+	}
+
+	logger.Infof("Transfer %s of volume %s has been created.", transfer.ID, vol.Name)
+
+	resp.Transfer = toTransfer(*transfer)
+	return resp
+}
+
+func (d *CinderDriver) TransferList(ctx context.Context, logger *logrus.Entry, req TransferListReq) TransferListResp {
+	resp := TransferListResp{
+		Transfers: make([]Transfer, 0),
+	}
+
+	allPages, err := volumetransfers.List(d.storageClient, nil).AllPages()
+	if err != nil {
+		resp.Err = fmt.Sprintf("listing volume transfers: %v", err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	list, err := volumetransfers.ExtractTransfers(allPages)
+	if err != nil {
+		resp.Err = fmt.Sprintf("extracting volume transfers from api response: %v", err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	for _, t := range list {
+		if strings.HasPrefix(t.Name, d.volumePrefix) {
+			resp.Transfers = append(resp.Transfers, toTransfer(t))
+		}
+	}
+
+	return resp
+}
+
+// TransferAccept accepts a transfer created in another project, and names the
+// volume after its name in that project, with the VOLUME_PREFIX of this one.
+func (d *CinderDriver) TransferAccept(ctx context.Context, logger *logrus.Entry, req TransferAcceptReq) TransferAcceptResp {
+	resp := TransferAcceptResp{}
+
+	if req.Name != "" && !strings.HasPrefix(req.Name, d.volumePrefix) {
+		resp.Err = fmt.Sprintf("volume name %s must start with the prefix %s", req.Name, d.volumePrefix)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+	if req.Name != "" {
+		if _, _, err := d.lookupVolume(req.Name); err == nil {
+			resp.Err = fmt.Sprintf("volume %s already exists", req.Name)
+			logger.Error(resp.Err)
+
+			return resp
+		} else if err != errVolumeNotFound {
+			resp.Err = err.Error()
+			logger.Error(resp.Err)
+
+			return resp
+		}
+	}
+
+	transfer, err := volumetransfers.Accept(d.storageClient, req.ID, volumetransfers.AcceptOpts{AuthKey: req.AuthKey}).Extract()
+	if err != nil {
+		resp.Err = fmt.Sprintf("could not accept transfer %s: %v", req.ID, err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	logger = logger.WithField("VolID", transfer.VolumeID)
+
+	vol, err := volumes.Get(d.storageClient, transfer.VolumeID).Extract()
+	if err != nil {
+		resp.Err = fmt.Sprintf("could not get transferred volume %s: %v", transfer.VolumeID, err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	name := req.Name
+	if name == "" {
+		name = transferredName(*vol, d.volumePrefix)
+	}
+
+	if _, _, err := d.lookupVolume(name); err == nil {
+		resp.Err = fmt.Sprintf("volume %s already exists, rename transferred volume %s with OpenStack", name, vol.ID)
+		logger.Error(resp.Err)
+
+		return resp
+	} else if err != errVolumeNotFound {
+		resp.Err = err.Error()
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	if name != vol.Name {
+		if _, err := volumes.Update(d.storageClient, vol.ID, volumes.UpdateOpts{Name: &name}).Extract(); err != nil {
+			resp.Err = fmt.Sprintf("could not rename transferred volume %s to %s: %v", vol.ID, name, err)
+			logger.Error(resp.Err)
+
+			return resp
+		}
+	}
+
+	// The writer lease belongs to a server of the other project.
+	for _, field := range []string{metadataFieldTransferName, metadataFieldWriter} {
+		if _, ok := vol.Metadata[field]; !ok {
+			continue
+		}
+		if err := d.deleteMetadata(vol.ID, field); err != nil {
+			logger.Warnf("Could not delete the metadata %s of volume %s: %v", field, name, err)
+		}
+	}
+
+	// Keys aren't transferred along with volumes.
+	if isEncrypted(*vol) {
+		if _, err := d.readKey(vol.Metadata[metadataFieldKeyRef], false); err != nil {
+			resp.Warning = fmt.Sprintf("volume %s is encrypted but its key can't be read on this host, it has to be copied before mounting the volume: %v", name, err)
+			logger.Warn(resp.Warning)
+		}
+	}
+
+	logger.Infof("Transfer %s has been accepted as volume %s.", req.ID, name)
+
+	resp.Name = name
+	return resp
+}
+
+func (d *CinderDriver) TransferRemove(ctx context.Context, logger *logrus.Entry, req TransferRemoveReq) TransferRemoveResp {
+	resp := TransferRemoveResp{}
+
+	if err := volumetransfers.Delete(d.storageClient, req.ID).ExtractErr(); err != nil {
+		resp.Err = fmt.Sprintf("failed to delete transfer %s: %v", req.ID, err)
+		logger.Error(resp.Err)
+
+		return resp
+	}
+
+	logger.Infof("Transfer %s has been deleted.", req.ID)
+
+	return resp
+}
+
+// transferredName returns the name of vol in this project: its name in the
+// project it comes from, with the prefix of this one.
+func transferredName(vol volumes.Volume, prefix string) string {
+	if name := vol.Metadata[metadataFieldTransferName]; name != "" {
+		return prefix + name
+	}
+	if strings.HasPrefix(vol.Name, prefix) {
+		return vol.Name
+	}
+
+	return prefix + vol.Name
+}
+
+func toTransfer(t volumetransfers.Transfer) Transfer {
+	return Transfer{
+		ID:        t.ID,
+		Volume:    t.Name,
+		VolumeID:  t.VolumeID,
+		AuthKey:   t.AuthKey,
+		CreatedAt: t.CreatedAt.String(),
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+
+	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -15,30 +17,46 @@ var (
 	errMoreThanOneFound = errors.New("more than one device with provided serial found")
 )
 
+// minTruncatedSerialLength is the length virtio-blk truncates serials to. Shorter
+// serials aren't matched by prefix, as they'd be too ambiguous.
+const minTruncatedSerialLength = 20
+
+const byIDDir = "/dev/disk/by-id"
+
+// findDevWithSerial returns the disk whose serial is expectedSerial, i.e. the
+// ID of a Cinder volume. Serials are read from several sources, as udev might
+// not be available, and hypervisors might truncate them.
 func findDevWithSerial(expectedSerial string) (string, error) {
-	entries, err := ioutil.ReadDir("/sys/class/block")
+	entries, err := os.ReadDir("/sys/class/block")
 	if err != nil {
 		return "", fmt.Errorf("could not find dev with serial: %v", err)
 	}
 
+	byID := readByIDLinks()
+
 	devices := make([]string, 0)
 	for _, entry := range entries {
 		sysname := entry.Name()
 
-		var major, minor string
-		major, minor, err = readUevent(sysname)
-		if err != nil {
-			return "", fmt.Errorf("could not find dev with serial: %v", err)
+		// Partitions share the serial of their disk.
+		if _, err := os.Stat(path.Join("/sys/class/block", sysname, "partition")); err == nil {
+			continue
 		}
 
-		var devSerial string
-		devSerial, err = readUdevData(major, minor)
+		// Devices unrelated to Cinder (e.g. loop, dm or zram devices) often
+		// have no serial at all, or vanish while being scanned, so errors
+		// are only logged.
+		serials, err := deviceSerials(sysname, byID[sysname])
 		if err != nil {
-			return "", fmt.Errorf("could not find dev with serial: %v", err)
+			logrus.Debugf("Could not read the serial of %s: %v", sysname, err)
+			continue
 		}
 
-		if devSerial == expectedSerial {
-			devices = append(devices, sysname)
+		for _, serial := range serials {
+			if matchSerial(serial, expectedSerial) {
+				devices = append(devices, sysname)
+				break
+			}
 		}
 	}
 
@@ -52,6 +70,62 @@ func findDevWithSerial(expectedSerial string) (string, error) {
 	return path.Join("/dev", devices[0]), nil
 }
 
+// matchSerial reports whether serial, as read from a device, is the one of the
+// volume volID. virtio-blk truncates serials to 20 characters.
+func matchSerial(serial, volID string) bool {
+	if serial == "" {
+		return false
+	}
+	if serial == volID {
+		return true
+	}
+
+	return len(serial) >= minTruncatedSerialLength && strings.HasPrefix(volID, serial)
+}
+
+// deviceSerials returns the serials of the disk sysname found by the first
+// source knowing them: the udev database, sysfs (virtio-blk), the SCSI VPD
+// pages, and finally the /dev/disk/by-id symlinks.
+func deviceSerials(sysname string, byIDNames []string) ([]string, error) {
+	major, minor, err := readUevent(sysname)
+	if err != nil {
+		return nil, err
+	}
+
+	if serial, err := readUdevData(major, minor); err == nil && serial != "" {
+		return []string{serial}, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	sysdir := path.Join("/sys/class/block", sysname)
+
+	if content, err := os.ReadFile(path.Join(sysdir, "serial")); err == nil {
+		if serial := strings.TrimSpace(string(content)); serial != "" {
+			return []string{serial}, nil
+		}
+	}
+
+	if content, err := os.ReadFile(path.Join(sysdir, "device", "vpd_pg80")); err == nil {
+		if serial := parseVPDSerial(content); serial != "" {
+			return []string{serial}, nil
+		}
+	}
+
+	if content, err := os.ReadFile(path.Join(sysdir, "device", "vpd_pg83")); err == nil {
+		if serials := parseVPDIdentifiers(content); len(serials) > 0 {
+			return serials, nil
+		}
+	}
+
+	serials := make([]string, 0, len(byIDNames))
+	for _, name := range byIDNames {
+		serials = append(serials, byIDSerials(name)...)
+	}
+
+	return serials, nil
+}
+
 func readUevent(sysname string) (string, string, error) {
 	uevent := path.Join("/sys/class/block", sysname, "uevent")
 
@@ -109,3 +183,102 @@ func readUdevData(major, minor string) (string, error) {
 
 	return serial, nil
 }
+
+// parseVPDSerial extracts the unit serial number from a SCSI VPD page 0x80.
+func parseVPDSerial(page []byte) string {
+	if len(page) < 4 || page[1] != 0x80 {
+		return ""
+	}
+
+	length := int(page[2])<<8 | int(page[3])
+	if 4+length > len(page) {
+		length = len(page) - 4
+	}
+
+	return strings.Trim(string(page[4:4+length]), " \x00")
+}
+
+// parseVPDIdentifiers extracts the textual designators from a SCSI VPD page
+// 0x83 (device identification). QEMU exposes the serial of disks as a vendor
+// specific or a T10 vendor ID designator.
+func parseVPDIdentifiers(page []byte) []string {
+	if len(page) < 4 || page[1] != 0x83 {
+		return nil
+	}
+
+	end := 4 + (int(page[2])<<8 | int(page[3]))
+	if end > len(page) {
+		end = len(page)
+	}
+
+	ids := make([]string, 0)
+	for off := 4; off+4 <= end; {
+		codeSet := page[off] & 0x0f
+		designatorType := page[off+1] & 0x0f
+		length := int(page[off+3])
+
+		data := page[off+4 : min(off+4+length, end)]
+		off += 4 + length
+
+		// Only ASCII (2) and UTF-8 (3) designators can hold a serial.
+		if codeSet != 2 && codeSet != 3 {
+			continue
+		}
+
+		id := strings.Trim(string(data), " \x00")
+		switch designatorType {
+		case 0:
+			ids = append(ids, id)
+		case 1:
+			// T10 vendor IDs start with an 8-byte vendor name.
+			if len(data) > 8 {
+				ids = append(ids, id, strings.Trim(string(data[8:]), " \x00"))
+			}
+		}
+	}
+
+	return ids
+}
+
+// readByIDLinks maps the name of each disk to the names of its symlinks in
+// /dev/disk/by-id. Partitions are left out.
+func readByIDLinks() map[string][]string {
+	links := map[string][]string{}
+
+	entries, err := os.ReadDir(byIDDir)
+	if err != nil {
+		return links
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.Contains(name, "-part") {
+			continue
+		}
+
+		target, err := filepath.EvalSymlinks(path.Join(byIDDir, name))
+		if err != nil {
+			continue
+		}
+
+		sysname := path.Base(target)
+		links[sysname] = append(links[sysname], name)
+	}
+
+	return links
+}
+
+// byIDSerials returns the serials a /dev/disk/by-id symlink name might hold,
+// e.g. virtio-<serial> or scsi-0QEMU_QEMU_HARDDISK_<serial>.
+func byIDSerials(name string) []string {
+	serials := make([]string, 0, 2)
+
+	if _, serial, ok := strings.Cut(name, "-"); ok {
+		serials = append(serials, serial)
+	}
+	if i := strings.LastIndex(name, "_"); i >= 0 {
+		serials = append(serials, name[i+1:])
+	}
+
+	return serials
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+const testVolID = "6a3ba9c2-1f4e-4b34-9d5e-0c1f2a3b4c5d"
+
+func TestMatchSerial(t *testing.T) {
+	tcs := []struct {
+		serial   string
+		expected bool
+	}{
+		{serial: testVolID, expected: true},
+		// virtio-blk truncates serials to 20 characters.
+		{serial: testVolID[:20], expected: true},
+		{serial: testVolID[:8], expected: false},
+		{serial: "", expected: false},
+		{serial: "7b4cb0d3-2a5f-4c45-a", expected: false},
+		{serial: testVolID + "0", expected: false},
+	}
+
+	for _, tc := range tcs {
+		if got := matchSerial(tc.serial, testVolID); got != tc.expected {
+			t.Errorf("matchSerial(%q): expected %t, got %t", tc.serial, tc.expected, got)
+		}
+	}
+}
+
+// vpdPage builds a SCSI VPD page with the given code and payload.
+func vpdPage(code byte, payload []byte) []byte {
+	return append([]byte{0, code, byte(len(payload) >> 8), byte(len(payload))}, payload...)
+}
+
+// vpdDesignator builds a designator of a VPD page 0x83.
+func vpdDesignator(codeSet, designatorType byte, data string) []byte {
+	return append([]byte{codeSet, designatorType, 0, byte(len(data))}, data...)
+}
+
+func TestParseVPDSerial(t *testing.T) {
+	tcs := []struct {
+		name     string
+		page     []byte
+		expected string
+	}{
+		{name: "serial", page: vpdPage(0x80, []byte(testVolID)), expected: testVolID},
+		{name: "padded serial", page: vpdPage(0x80, []byte("  "+testVolID+"\x00\x00")), expected: testVolID},
+		{name: "length beyond page", page: vpdPage(0x80, []byte(testVolID))[:24], expected: testVolID[:20]},
+		{name: "wrong page", page: vpdPage(0x83, []byte(testVolID)), expected: ""},
+		{name: "short page", page: []byte{0, 0x80}, expected: ""},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := parseVPDSerial(tc.page); got != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseVPDIdentifiers(t *testing.T) {
+	concat := func(designators ...[]byte) []byte {
+		return slices.Concat(designators...)
+	}
+
+	tcs := []struct {
+		name     string
+		page     []byte
+		expected []string
+	}{
+		{
+			name:     "vendor specific",
+			page:     vpdPage(0x83, vpdDesignator(2, 0, testVolID)),
+			expected: []string{testVolID},
+		},
+		{
+			name:     "T10 vendor ID",
+			page:     vpdPage(0x83, vpdDesignator(2, 1, "QEMU    "+testVolID)),
+			expected: []string{"QEMU    " + testVolID, testVolID},
+		},
+		{
+			name: "binary designators are skipped",
+			page: vpdPage(0x83, concat(
+				vpdDesignator(1, 3, "\x60\x01\x40\x50\x00\x00\x00\x01"),
+				vpdDesignator(3, 0, testVolID+" "),
+			)),
+			expected: []string{testVolID},
+		},
+		{
+			name:     "other designator types are skipped",
+			page:     vpdPage(0x83, vpdDesignator(2, 8, "iqn.2010-10.org.openstack:"+testVolID)),
+			expected: []string{},
+		},
+		{
+			name:     "truncated designator",
+			page:     vpdPage(0x83, vpdDesignator(2, 0, testVolID))[:28],
+			expected: []string{testVolID[:20]},
+		},
+		{
+			name:     "wrong page",
+			page:     vpdPage(0x80, vpdDesignator(2, 0, testVolID)),
+			expected: nil,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseVPDIdentifiers(tc.page)
+			if !slices.Equal(got, tc.expected) || (got == nil) != (tc.expected == nil) {
+				t.Fatalf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestByIDSerials(t *testing.T) {
+	tcs := []struct {
+		name     string
+		expected []string
+	}{
+		{name: "virtio-" + testVolID[:20], expected: []string{testVolID[:20]}},
+		{name: "scsi-0QEMU_QEMU_HARDDISK_" + testVolID, expected: []string{"0QEMU_QEMU_HARDDISK_" + testVolID, testVolID}},
+		{name: "wwn-0x6001405000000001", expected: []string{"0x6001405000000001"}},
+		{name: "nodash", expected: []string{}},
+	}
+
+	for _, tc := range tcs {
+		if got := byIDSerials(tc.name); !slices.Equal(got, tc.expected) {
+			t.Errorf("byIDSerials(%s): expected %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+}
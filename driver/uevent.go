@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// udevMonitorGroup is the netlink multicast group udevd sends events to once
+// it's done processing them, as opposed to the kernel group (1).
+const udevMonitorGroup = 2
+
+// udevMonitorMagic is found at the start of the header of udev messages, right
+// after the "libudev" prefix.
+const udevMonitorMagic = 0xfeedcafe
+
+// defaultDeviceWaitTimeout bounds how long the device of a volume is waited
+// for after attaching it, and its removal after detaching it.
+const defaultDeviceWaitTimeout = 30 * time.Second
+
+const (
+	// devicePollInterval is how often devices are looked up while waiting
+	// for them without netlink events.
+	devicePollInterval = 250 * time.Millisecond
+	// deviceRescanInterval is how often devices are looked up anyway while
+	// waiting for netlink events, in case one was missed.
+	deviceRescanInterval = 2 * time.Second
+)
+
+// uevent is a device event broadcasted by udevd.
+type uevent struct {
+	Action string
+	Props  map[string]string
+}
+
+// deviceMonitor listens to udev events, and hands them to the subscribers
+// waiting for a device to appear or disappear. When netlink isn't available,
+// waiters fall back to polling.
+type deviceMonitor struct {
+	mu          sync.Mutex
+	subscribers map[chan uevent]struct{}
+	available   bool
+}
+
+func newDeviceMonitor() *deviceMonitor {
+	m := &deviceMonitor{
+		subscribers: map[chan uevent]struct{}{},
+	}
+
+	fd, err := openUeventSocket()
+	if err != nil {
+		logrus.Warnf("Could not listen to udev events, falling back to polling for devices: %v", err)
+		return m
+	}
+
+	m.available = true
+	go m.run(fd)
+
+	return m
+}
+
+func openUeventSocket() (int, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return -1, fmt.Errorf("creating netlink socket: %v", err)
+	}
+
+	// Events are bursty (e.g. when several disks are attached at once), so
+	// make room for them.
+	_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, 1<<20)
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: udevMonitorGroup}); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("binding netlink socket: %v", err)
+	}
+
+	return fd, nil
+}
+
+func (m *deviceMonitor) run(fd int) {
+	buf := make([]byte, 64<<10)
+
+	for {
+		n, from, err := unix.Recvfrom(fd, buf, 0)
+		if err == unix.EINTR {
+			continue
+		} else if err == unix.ENOBUFS {
+			// Events were dropped. Waiters rescan devices periodically anyway.
+			logrus.Debug("The udev event buffer overflowed.")
+			continue
+		} else if err != nil {
+			logrus.Errorf("Could not receive udev events anymore, falling back to polling for devices: %v", err)
+
+			m.mu.Lock()
+			m.available = false
+			m.mu.Unlock()
+
+			unix.Close(fd)
+			return
+		}
+
+		// Only udevd (as opposed to the kernel, whose port ID is 0) sends
+		// messages to this group.
+		if nl, ok := from.(*unix.SockaddrNetlink); !ok || nl.Pid == 0 {
+			continue
+		}
+
+		ev, ok := parseUdevMessage(buf[:n])
+		if !ok || ev.Props["SUBSYSTEM"] != "block" {
+			continue
+		}
+
+		m.mu.Lock()
+		for ch := range m.subscribers {
+			select {
+			case ch <- ev:
+			default:
+				// The subscriber is busy scanning devices, it'll notice the
+				// device anyway.
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// parseUdevMessage decodes a message sent by udevd: a "libudev" header
+// followed by NUL-separated KEY=VALUE properties.
+func parseUdevMessage(msg []byte) (uevent, bool) {
+	const headerSize = 40
+
+	if len(msg) < headerSize || !bytes.HasPrefix(msg, []byte("libudev\x00")) {
+		return uevent{}, false
+	}
+	if binary.BigEndian.Uint32(msg[8:12]) != udevMonitorMagic {
+		return uevent{}, false
+	}
+
+	off := binary.NativeEndian.Uint32(msg[16:20])
+	length := binary.NativeEndian.Uint32(msg[20:24])
+	if uint64(off)+uint64(length) > uint64(len(msg)) {
+		return uevent{}, false
+	}
+
+	ev := uevent{Props: map[string]string{}}
+	for _, prop := range bytes.Split(msg[off:off+length], []byte{0}) {
+		k, v, ok := strings.Cut(string(prop), "=")
+		if ok {
+			ev.Props[k] = v
+		}
+	}
+	ev.Action = ev.Props["ACTION"]
+
+	return ev, ev.Action != ""
+}
+
+// subscribe starts collecting events. Subscribing before attaching or
+// detaching a volume makes sure no event is missed.
+func (m *deviceMonitor) subscribe() chan uevent {
+	ch := make(chan uevent, 16)
+
+	m.mu.Lock()
+	m.subscribers[ch] = struct{}{}
+	m.mu.Unlock()
+
+	return ch
+}
+
+func (m *deviceMonitor) unsubscribe(ch chan uevent) {
+	m.mu.Lock()
+	delete(m.subscribers, ch)
+	m.mu.Unlock()
+}
+
+func (m *deviceMonitor) isAvailable() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.available
+}
+
+// waitForDevice waits until udev is done processing the disk with the given
+// serial, and returns its path.
+func (m *deviceMonitor) waitForDevice(ctx context.Context, events chan uevent, serial string, timeout time.Duration) (string, error) {
+	return m.wait(ctx, events, timeout, func(ev *uevent) (string, bool, error) {
+		if ev != nil && !isDiskEvent(*ev) {
+			return "", false, nil
+		}
+		// Without udev rules setting ID_SERIAL_SHORT, devices are looked up
+		// through the other sources.
+		if ev != nil && (ev.Action == "add" || ev.Action == "change") && matchSerial(ev.Props["ID_SERIAL_SHORT"], serial) {
+			return devPath(ev.Props["DEVNAME"]), true, nil
+		}
+
+		dev, err := findDevWithSerial(serial)
+		if err == errDeviceNotFound {
+			return "", false, nil
+		}
+
+		return dev, err == nil, err
+	})
+}
+
+// waitForDeviceRemoval waits until the disk with the given serial is gone.
+func (m *deviceMonitor) waitForDeviceRemoval(ctx context.Context, events chan uevent, serial string, timeout time.Duration) error {
+	_, err := m.wait(ctx, events, timeout, func(ev *uevent) (string, bool, error) {
+		if ev != nil && !isDiskEvent(*ev) {
+			return "", false, nil
+		}
+		if ev != nil && ev.Action == "remove" && matchSerial(ev.Props["ID_SERIAL_SHORT"], serial) {
+			return "", true, nil
+		}
+
+		_, err := findDevWithSerial(serial)
+		if err == errDeviceNotFound {
+			return "", true, nil
+		}
+
+		return "", false, err
+	})
+
+	return err
+}
+
+// wait calls check with each event received, and without event right away
+// and then periodically, until it's done, timeout expires or ctx is done.
+// check scans devices unless the event is enough to conclude.
+func (m *deviceMonitor) wait(ctx context.Context, events chan uevent, timeout time.Duration, check func(ev *uevent) (string, bool, error)) (string, error) {
+	interval := devicePollInterval
+	if m.isAvailable() {
+		interval = deviceRescanInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	var lastErr error
+	var ev *uevent
+	for {
+		dev, done, err := check(ev)
+		if done {
+			return dev, nil
+		}
+		if err != nil {
+			// Devices might disappear or not be processed by udev yet while
+			// scanning them, so errors are only reported on timeout.
+			lastErr = err
+		}
+
+		ev = nil
+		select {
+		case e := <-events:
+			ev = &e
+		case <-ticker.C:
+		case <-ctx.Done():
+			return "", fmt.Errorf("gave up: %v", ctx.Err())
+		case <-deadline.C:
+			if lastErr != nil {
+				return "", fmt.Errorf("timed out after %s: %v", timeout, lastErr)
+			}
+			return "", fmt.Errorf("timed out after %s", timeout)
+		}
+	}
+}
+
+func isDiskEvent(ev uevent) bool {
+	return ev.Props["DEVTYPE"] == "disk"
+}
+
+// devPath returns the path of a device, given the DEVNAME property of its
+// events, which udev sets to an absolute path.
+func devPath(devname string) string {
+	if strings.HasPrefix(devname, "/dev/") {
+		return devname
+	}
+
+	return path.Join("/dev", devname)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// udevMessage builds a message as sent by udevd, holding the given properties.
+func udevMessage(magic uint32, props ...string) []byte {
+	const headerSize = 40
+
+	payload := []byte(strings.Join(props, "\x00") + "\x00")
+
+	msg := make([]byte, headerSize, headerSize+len(payload))
+	copy(msg, "libudev\x00")
+	binary.BigEndian.PutUint32(msg[8:12], magic)
+	binary.NativeEndian.PutUint32(msg[12:16], headerSize)
+	binary.NativeEndian.PutUint32(msg[16:20], headerSize)
+	binary.NativeEndian.PutUint32(msg[20:24], uint32(len(payload)))
+
+	return append(msg, payload...)
+}
+
+func TestParseUdevMessage(t *testing.T) {
+	tcs := []struct {
+		name     string
+		msg      []byte
+		ok       bool
+		expected map[string]string
+	}{
+		{
+			name: "disk added",
+			msg:  udevMessage(udevMonitorMagic, "ACTION=add", "SUBSYSTEM=block", "DEVTYPE=disk", "DEVNAME=/dev/vdb", "ID_SERIAL_SHORT=6a3ba9c2-1f4e-4b34-9"),
+			ok:   true,
+			expected: map[string]string{
+				"ACTION":          "add",
+				"SUBSYSTEM":       "block",
+				"DEVTYPE":         "disk",
+				"DEVNAME":         "/dev/vdb",
+				"ID_SERIAL_SHORT": "6a3ba9c2-1f4e-4b34-9",
+			},
+		},
+		{
+			name: "values holding =",
+			msg:  udevMessage(udevMonitorMagic, "ACTION=change", "ID_PATH=pci-0000:00:07.0=x"),
+			ok:   true,
+			expected: map[string]string{
+				"ACTION":  "change",
+				"ID_PATH": "pci-0000:00:07.0=x",
+			},
+		},
+		{
+			name: "kernel message",
+			msg:  []byte("add@/devices/pci0000:00/virtio4/block/vdb\x00ACTION=add\x00SUBSYSTEM=block\x00DEVNAME=vdb\x00padding-up-to-forty-bytes"),
+		},
+		{
+			name: "wrong magic",
+			msg:  udevMessage(0xcafefeed, "ACTION=add"),
+		},
+		{
+			name: "truncated header",
+			msg:  udevMessage(udevMonitorMagic, "ACTION=add")[:30],
+		},
+		{
+			name: "truncated properties",
+			msg: func() []byte {
+				msg := udevMessage(udevMonitorMagic, "ACTION=add", "DEVNAME=/dev/vdb")
+				return msg[:len(msg)-4]
+			}(),
+		},
+		{
+			name: "no action",
+			msg:  udevMessage(udevMonitorMagic, "SUBSYSTEM=block"),
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			ev, ok := parseUdevMessage(tc.msg)
+			if ok != tc.ok {
+				t.Fatalf("expected ok to be %t, got %t (%+v)", tc.ok, ok, ev)
+			}
+			if !ok {
+				return
+			}
+
+			if ev.Action != tc.expected["ACTION"] {
+				t.Errorf("expected action %s, got %s", tc.expected["ACTION"], ev.Action)
+			}
+			if len(ev.Props) != len(tc.expected) {
+				t.Errorf("expected props %v, got %v", tc.expected, ev.Props)
+			}
+			for k, v := range tc.expected {
+				if ev.Props[k] != v {
+					t.Errorf("expected %s=%s, got %s", k, v, ev.Props[k])
+				}
+			}
+		})
+	}
+}
+
+func TestDevPath(t *testing.T) {
+	for devname, expected := range map[string]string{
+		"/dev/vdb":      "/dev/vdb",
+		"vdb":           "/dev/vdb",
+		"mapper/cinder": "/dev/mapper/cinder",
+	} {
+		if got := devPath(devname); got != expected {
+			t.Errorf("devPath(%s): expected %s, got %s", devname, expected, got)
+		}
+	}
+}
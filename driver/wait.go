@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// defaultOperationTimeout bounds how long OpenStack operations are waited for
+// when their timeout isn't configured.
+const defaultOperationTimeout = 60 * time.Second
+
+// pollInterval is how often the status of OpenStack resources is checked while
+// waiting for them.
+const pollInterval = time.Second
+
+// Timeouts bound how long each kind of OpenStack operation is waited for.
+// Podman gives up on requests after its volume_plugin_timeout, so they should
+// be shorter than it.
+type Timeouts struct {
+	Create   time.Duration
+	Delete   time.Duration
+	Attach   time.Duration
+	Detach   time.Duration
+	Extend   time.Duration
+	Snapshot time.Duration
+}
+
+// waitFor calls predicate right away and then periodically, until it's done,
+// it fails, timeout expires or ctx is done. ctx is usually the context of the
+// request being served, which is canceled when the client disconnects.
+func waitFor(ctx context.Context, timeout time.Duration, predicate func() (bool, error)) error {
+	return waitForEvery(ctx, pollInterval, timeout, predicate)
+}
+
+// waitForEvery is like waitFor, but calls predicate every interval.
+func waitForEvery(ctx context.Context, interval, timeout time.Duration, predicate func() (bool, error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		if done, err := predicate(); err != nil {
+			return err
+		} else if done {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up: %v", ctx.Err())
+		case <-deadline.C:
+			return fmt.Errorf("timed out after %s", timeout)
+		case <-ticker.C:
+		}
+	}
+}